@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// Encryption with age, see https://age-encryption.org.  Unlike the
+// encrypt filter, put only needs the public keys of the recipients, the
+// identity (private key) is only needed at restore, and can be kept
+// offline.  Any age tool can decrypt the stored data.
+
+type agefilter struct {
+	keys *keyopts
+}
+
+// Parse the recipients of -encrypt-to: age1... public keys, or files with
+// one per line.
+func agerecipients(l []string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, s := range l {
+		if strings.HasPrefix(s, "age1") {
+			r, err := age.ParseX25519Recipient(s)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, r)
+			continue
+		}
+		f, err := os.Open(s)
+		if err != nil {
+			return nil, err
+		}
+		rl, err := age.ParseRecipients(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s, err)
+		}
+		recipients = append(recipients, rl...)
+	}
+	return recipients, nil
+}
+
+func (f agefilter) encode(r io.Reader, header http.Header) (io.Reader, error) {
+	if len(f.keys.recipients) == 0 {
+		return nil, errors.New("age filter needs -encrypt-to")
+	}
+	recipients, err := agerecipients(f.keys.recipients)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		aw, err := age.Encrypt(pw, recipients...)
+		if err == nil {
+			_, err = io.Copy(aw, r)
+			if cerr := aw.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func (f agefilter) decode(r io.Reader, header http.Header) (io.Reader, error) {
+	if f.keys.identityfile == "" {
+		return nil, errors.New("file is encrypted with age, decrypting needs -identity")
+	}
+	idf, err := os.Open(f.keys.identityfile)
+	if err != nil {
+		return nil, err
+	}
+	defer idf.Close()
+	identities, err := age.ParseIdentities(idf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.keys.identityfile, err)
+	}
+	return age.Decrypt(r, identities...)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"bitbucket.org/mjl/cloudstream/objects"
+)
+
+// Requests of package objects go through request and putobject, with the
+// configuration and credentials of the command.  Package objects is the
+// Go API for other programs, with their own backend.
+
+var objectclient = &objects.Client{Backend: commandbackend{}}
+
+type commandbackend struct{}
+
+func (commandbackend) Request(ctx context.Context, method, path string, header http.Header, body io.Reader) (*http.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return request(method, path, header, body)
+}
+
+func (commandbackend) Put(ctx context.Context, path string, header http.Header, body io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	resp, err := putobject(path, header, body)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// Reader for path of size, e.g. as listed, see objects.Reader.  If etag is
+// empty, reads don't fail when the object is replaced.
+func newobjectreader(path string, size int64, etag string) *objects.Reader {
+	return objectclient.ObjectReader(context.Background(), path, size, etag)
+}
+
+// Start an upload to path, with the content-type set by the extension,
+// see objects.Writer.
+func newobjectwriter(path string) *objects.Writer {
+	header := http.Header{}
+	if t := extensiontype(path); t != "" {
+		header.Set("Content-Type", t)
+	}
+	return objectclient.NewWriter(context.Background(), path, header)
+}
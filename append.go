@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"bitbucket.org/mjl/cloudstream/objects"
+)
+
+// Appending to a file, for shipping logs.  Cloud storage files can't
+// be changed, new data is uploaded as a temporary file and composed
+// onto the existing file, making a new generation.  The compose has the
+// generation of the existing file as precondition, an append by another
+// process in between fails instead of being lost.
+
+// Append data from src to path, in appends of at most maxsize bytes.
+// Data is appended at least every interval, if non-zero, e.g. for
+// following a log with "tail -F".  Header holds the headers for path,
+// if it is created.
+func putappend(path string, header http.Header, src io.Reader, interval time.Duration, maxsize int64) {
+	type read struct {
+		buf []byte
+		err error
+	}
+	reads := make(chan read)
+	go func() {
+		for {
+			buf := make([]byte, 64*1024)
+			n, err := src.Read(buf)
+			reads <- read{buf[:n], err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var pending []byte
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if err := appendobject(path, header, pending); err != nil {
+			failerror(err)
+		}
+		pending = nil
+	}
+	var timer <-chan time.Time
+	for {
+		select {
+		case r := <-reads:
+			pending = append(pending, r.buf...)
+			if r.err == io.EOF {
+				flush()
+				return
+			} else if r.err != nil {
+				fail(r.err.Error())
+			}
+			if int64(len(pending)) >= maxsize {
+				flush()
+				timer = nil
+			} else if timer == nil && interval > 0 && len(pending) > 0 {
+				timer = time.After(interval)
+			}
+		case <-timer:
+			flush()
+			timer = nil
+		}
+	}
+}
+
+// Append data to the file at path, creating it with header if it does
+// not exist.
+func appendobject(path string, header http.Header, data []byte) error {
+	h := http.Header{}
+	oh, err := headwith(path, acceptgzip(nil))
+	if iserrorstatus(err, http.StatusNotFound) {
+		for k, v := range header {
+			h[k] = v
+		}
+		h.Set("x-goog-if-generation-match", "0")
+		h.Set("x-goog-hash", datahash(data).header())
+		resp, err := putobject(path, h, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	// Appended data would not be decoded with the existing data.
+	if oh.Get(filtersheader) != "" || oh.Get("Content-Encoding") != "" {
+		return fmt.Errorf("%s: cannot append to a file stored with filters or a content-encoding", path)
+	}
+
+	rnd := make([]byte, 8)
+	if _, err := rand.Read(rnd); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.cloudstream-append-%x", path, rnd)
+	resp, err := putobject(tmp, http.Header{"x-goog-hash": {datahash(data).header()}}, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	defer func() {
+		if err := deleteobject(tmp, nil); err != nil && !iserrorstatus(err, 404) {
+			fmt.Fprintf(os.Stderr, "removing temporary file %s: %s\n", tmp, err)
+		}
+	}()
+
+	// The composed file gets the metadata of the request, not of the
+	// existing file.
+	h = objects.ObjectHeaders(oh)
+	for _, k := range []string{"x-goog-acl", "x-goog-encryption-kms-key-name"} {
+		if v := header.Get(k); v != "" {
+			h.Set(k, v)
+		}
+	}
+	h.Set("x-goog-if-generation-match", oh.Get("x-goog-generation"))
+	resp, err = compose(path, []string{path, tmp}, h)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
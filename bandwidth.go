@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bandwidth limit during a time of day.  The window can wrap around
+// midnight, e.g. 22:00-06:00.  A window without times covers the whole
+// day.
+type bandwidthwindow struct {
+	Start, End time.Duration // Since midnight, local time.
+	Rate       int64         // Bytes per second, 0 for unlimited.
+}
+
+// Parse "hh:mm-hh:mm" into a window, without rate.
+func parsewindow(s string) (bandwidthwindow, error) {
+	var w bandwidthwindow
+	t := strings.Split(s, "-")
+	if len(t) != 2 {
+		return w, fmt.Errorf("bad time window %q, must be hh:mm-hh:mm", s)
+	}
+	for i, ts := range t {
+		tm, err := time.Parse("15:04", ts)
+		if err != nil {
+			return w, fmt.Errorf("bad time %q in window %q", ts, s)
+		}
+		d := time.Duration(tm.Hour())*time.Hour + time.Duration(tm.Minute())*time.Minute
+		if i == 0 {
+			w.Start = d
+		} else {
+			w.End = d
+		}
+	}
+	return w, nil
+}
+
+// Current bandwidth limit, of the first window in the configuration that
+// contains the time of day, in bytes per second, 0 for unlimited.  Looked
+// up for each read and write, so long transfers follow the windows.
+func currentrate(now time.Time) int64 {
+	y, m, d := now.Date()
+	tod := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+	for _, w := range config.Bandwidth {
+		switch {
+		case w.Start == w.End,
+			w.Start < w.End && tod >= w.Start && tod < w.End,
+			w.Start > w.End && (tod >= w.Start || tod < w.End):
+			return w.Rate
+		}
+	}
+	return 0
+}
+
+// Limiter shared by all connections, so the limit holds for the total of
+// concurrent transfers.
+var bandwidth struct {
+	sync.Mutex
+	next time.Time // When the next byte may be transferred.
+}
+
+// Wait until n more bytes can be transferred at the current rate.
+func bandwidthwait(n int) {
+	rate := currentrate(time.Now())
+	if rate == 0 || n == 0 {
+		return
+	}
+	bandwidth.Lock()
+	now := time.Now()
+	if bandwidth.next.Before(now) {
+		bandwidth.next = now
+	}
+	d := bandwidth.next.Sub(now)
+	bandwidth.next = bandwidth.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	bandwidth.Unlock()
+	time.Sleep(d)
+}
+
+// Connection with reads and writes subject to the bandwidth limit, in
+// small pieces so the limit is smooth.
+type limitedconn struct {
+	net.Conn
+}
+
+const limitpiece = 16 * 1024
+
+func (c limitedconn) Read(buf []byte) (int, error) {
+	if len(buf) > limitpiece {
+		buf = buf[:limitpiece]
+	}
+	n, err := c.Conn.Read(buf)
+	bandwidthwait(n)
+	return n, err
+}
+
+func (c limitedconn) Write(buf []byte) (int, error) {
+	var n int
+	for len(buf) > 0 {
+		piece := buf
+		if len(piece) > limitpiece {
+			piece = piece[:limitpiece]
+		}
+		bandwidthwait(len(piece))
+		nn, err := c.Conn.Write(piece)
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		buf = buf[nn:]
+	}
+	return n, nil
+}
+
+// Transport with connections subject to the bandwidth windows of the
+// configuration.
+func limitedtransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return limitedconn{conn}, nil
+	}
+	return t
+}
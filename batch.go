@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Operations on many files, read from stdin, one per line, executed
+// concurrently in a single process.  Starting a process for each file is
+// slow, with a new connection and credentials for each.
+
+func batch(args []string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	fs.Usage = usage
+	concurrency := fs.Int("concurrency", 8, "number of operations to execute at a time")
+	keys := keyflags(fs, "")
+	fs.Var(&keys.recipients, "encrypt-to", "encrypt put files with age to recipient, an age1... public key or file with keys, can be repeated")
+	fs.StringVar(&keys.identityfile, "identity", "", "file with age identities, for decrypting get files encrypted with age")
+	ciphername := fs.String("cipher", "aes-256-gcm", "cipher for encryption, aes-256-gcm or xchacha20-poly1305")
+	filterspec := fs.String("filters", config.Filters, "filter pipeline for put, e.g. gzip,encrypt")
+	compress := fs.String("compress", "", "compress put files with gzip[:level] or zstd[:level], before the other filters")
+	onerror := onerrorflag(fs)
+	args = parseflags(fs, args)
+	if len(args) != 0 || *concurrency < 1 {
+		usage()
+	}
+	if *onerror == "retry-later" {
+		fail("-on-error retry-later needs a state file, see sync")
+	}
+	checkonerror(*onerror, "")
+	spec, filters := putfilters(*filterspec, *compress, *ciphername, keys)
+	// Ask for a passphrase once, before operations start concurrently.
+	if keys.usepassphrase() {
+		if _, err := keys.passphrase(true); err != nil {
+			fail(err.Error())
+		}
+	}
+
+	type line struct {
+		number int
+		text   string
+	}
+	lines := make(chan line)
+	var mutex sync.Mutex
+	var total, failed, skipped int
+	var stopped bool
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range lines {
+				mutex.Lock()
+				if stopped {
+					skipped++
+					mutex.Unlock()
+					continue
+				}
+				mutex.Unlock()
+
+				err := batchop(l.text, filters, spec, keys)
+
+				mutex.Lock()
+				if err != nil {
+					failed++
+					fmt.Fprintf(os.Stderr, "error line %d: %s: %s\n", l.number, l.text, err)
+					stopped = *onerror == "fail"
+				} else {
+					fmt.Println(l.text)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	number := 0
+	for scanner.Scan() {
+		number++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		total++
+		lines <- line{number, s}
+	}
+	close(lines)
+	wg.Wait()
+	if err := scanner.Err(); err != nil {
+		fail("reading operations: " + err.Error())
+	}
+	if skipped > 0 {
+		fail(fmt.Sprintf("stopped after %d failed operations, %d operations skipped", failed, skipped))
+	}
+	if failed > 0 {
+		fail(fmt.Sprintf("%d of %d operations failed", failed, total))
+	}
+}
+
+// Execute an operation of batch: "put localpath path", "get path
+// localpath", "cp src dst" or "rm path".
+func batchop(s string, filters []filter, spec string, keys *keyopts) error {
+	t, err := batchfields(s)
+	if err != nil {
+		return err
+	}
+	nargs := map[string]int{"put": 2, "get": 2, "cp": 2, "rm": 1}
+	if n, ok := nargs[t[0]]; !ok {
+		return fmt.Errorf("unknown operation %q, must be put, get, cp or rm", t[0])
+	} else if len(t) != 1+n {
+		return fmt.Errorf("operation %s needs %d parameters", t[0], n)
+	}
+	switch t[0] {
+	case "put":
+		return putlocal(t[1], makepath(t[2]), http.Header{}, filters, spec, spec == "")
+	case "get":
+		_, err := getfile(makepath(t[1]), t[2], nil, keys, true)
+		return err
+	case "cp":
+		return copyobject(makepath(t[1]), makepath(t[2]), nil, false, false)
+	default:
+		return deleteobject(makepath(t[1]), nil)
+	}
+}
+
+// Word for an operation line, double-quoted if it would not be read back
+// as is by batchfields.
+func batchquote(s string) string {
+	if s == "" || strings.HasPrefix(s, "\"") || strings.HasPrefix(s, "#") || strings.IndexFunc(s, func(c rune) bool { return !unicode.IsPrint(c) || unicode.IsSpace(c) }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// Split an operation line into words, separated by white space.  Words
+// with spaces or other special characters are double-quoted, with
+// backslash escapes like in Go.
+func batchfields(s string) ([]string, error) {
+	var l []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return l, nil
+		}
+		if s[0] != '"' {
+			i := strings.IndexAny(s, " \t")
+			if i < 0 {
+				i = len(s)
+			}
+			l = append(l, s[:i])
+			s = s[i:]
+			continue
+		}
+		i := 1
+		for i < len(s) && s[i] != '"' {
+			if s[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(s) {
+			return nil, errors.New("unterminated quoted word")
+		}
+		w, err := strconv.Unquote(s[:i+1])
+		if err != nil {
+			return nil, fmt.Errorf("bad quoted word %s", s[:i+1])
+		}
+		l = append(l, w)
+		s = s[i+1:]
+		if s != "" && s[0] != ' ' && s[0] != '\t' {
+			return nil, errors.New("quoted word must be followed by white space")
+		}
+	}
+}
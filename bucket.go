@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Fetch a bucket configuration sub-resource, e.g. "versioning", and
+// parse the xml into v.
+func getbucketconfig(bucket, subresource string, v interface{}) error {
+	resp, err := request("GET", "/"+bucket+"?"+subresource, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return statuserror(resp)
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("parsing %s configuration: %s", subresource, err)
+	}
+	return nil
+}
+
+// Set a bucket configuration sub-resource to the xml of v.
+func setbucketconfig(bucket, subresource string, v interface{}) error {
+	buf, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := request("PUT", "/"+bucket+"?"+subresource, nil, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return statuserror(resp)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// Bucket name from a command-line argument like "/bucket".
+func bucketarg(s string) string {
+	bucket, name := splitpath(makepath(s))
+	if bucket == "" || name != "" {
+		fail(fmt.Sprintf("bad bucket %q", s))
+	}
+	return bucket
+}
+
+type versioningconfig struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Status  string   `xml:",omitempty"` // "Enabled" or "Suspended", empty if never enabled.
+}
+
+func versioning(args []string) {
+	if len(args) != 2 {
+		usage()
+	}
+	bucket := bucketarg(args[1])
+	var err error
+	switch args[0] {
+	case "on":
+		err = setbucketconfig(bucket, "versioning", versioningconfig{Status: "Enabled"})
+	case "off":
+		err = setbucketconfig(bucket, "versioning", versioningconfig{Status: "Suspended"})
+	case "status":
+		var vc versioningconfig
+		err = getbucketconfig(bucket, "versioning", &vc)
+		if err == nil {
+			status := strings.ToLower(vc.Status)
+			if status == "" {
+				status = "off"
+			}
+			fmt.Println(status)
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+}
+
+type autoclassconfig struct {
+	Enabled              bool   `json:"enabled"`
+	TerminalStorageClass string `json:"terminalStorageClass,omitempty"`
+}
+
+func autoclass(args []string) {
+	fs := flag.NewFlagSet("autoclass", flag.ExitOnError)
+	fs.Usage = usage
+	terminal := fs.String("terminal-class", "", "storage class objects end up in, NEARLINE or ARCHIVE")
+	args = parseflags(fs, args)
+	if len(args) != 2 || (*terminal != "" && args[0] != "on") {
+		usage()
+	}
+	bucket := bucketarg(args[1])
+	var err error
+	switch args[0] {
+	case "on":
+		ac := autoclassconfig{Enabled: true, TerminalStorageClass: strings.ToUpper(*terminal)}
+		err = jsonrequest("PATCH", "/b/"+bucket, map[string]interface{}{"autoclass": ac}, nil)
+	case "off":
+		err = jsonrequest("PATCH", "/b/"+bucket, map[string]interface{}{"autoclass": autoclassconfig{}}, nil)
+	case "status":
+		var b struct {
+			Autoclass *autoclassconfig `json:"autoclass"`
+		}
+		err = jsonrequest("GET", "/b/"+bucket+"?fields=autoclass", nil, &b)
+		if err == nil {
+			if b.Autoclass == nil || !b.Autoclass.Enabled {
+				fmt.Println("off")
+			} else if b.Autoclass.TerminalStorageClass != "" {
+				fmt.Println("on, terminal class " + b.Autoclass.TerminalStorageClass)
+			} else {
+				fmt.Println("on")
+			}
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+}
+
+type encryptionconfig struct {
+	XMLName           xml.Name `xml:"EncryptionConfiguration"`
+	DefaultKmsKeyName string   `xml:",omitempty"`
+}
+
+func defaultkms(args []string) {
+	if len(args) < 2 {
+		usage()
+	}
+	var err error
+	switch {
+	case args[0] == "set" && len(args) == 3:
+		err = setbucketconfig(bucketarg(args[2]), "encryption", encryptionconfig{DefaultKmsKeyName: args[1]})
+	case args[0] == "clear" && len(args) == 2:
+		err = setbucketconfig(bucketarg(args[1]), "encryption", encryptionconfig{})
+	case args[0] == "status" && len(args) == 2:
+		var ec encryptionconfig
+		err = getbucketconfig(bucketarg(args[1]), "encryption", &ec)
+		if err == nil {
+			if ec.DefaultKmsKeyName == "" {
+				fmt.Println("none")
+			} else {
+				fmt.Println(ec.DefaultKmsKeyName)
+			}
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+}
+
+type iamconfiguration struct {
+	UniformBucketLevelAccess struct {
+		Enabled    bool   `json:"enabled"`
+		LockedTime string `json:"lockedTime,omitempty"`
+	} `json:"uniformBucketLevelAccess"`
+}
+
+func uniformaccess(args []string) {
+	if len(args) != 2 {
+		usage()
+	}
+	bucket := bucketarg(args[1])
+	var err error
+	switch args[0] {
+	case "on", "off":
+		var ic iamconfiguration
+		ic.UniformBucketLevelAccess.Enabled = args[0] == "on"
+		err = jsonrequest("PATCH", "/b/"+bucket, map[string]interface{}{"iamConfiguration": ic}, nil)
+	case "status":
+		var b struct {
+			IamConfiguration iamconfiguration `json:"iamConfiguration"`
+		}
+		err = jsonrequest("GET", "/b/"+bucket+"?fields=iamConfiguration", nil, &b)
+		if err == nil {
+			if b.IamConfiguration.UniformBucketLevelAccess.Enabled {
+				fmt.Println("on")
+			} else {
+				fmt.Println("off")
+			}
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+}
+
+// Error for a failed acl request on bucket.  With uniform bucket-level
+// access, acls are disabled and the server only responds with a terse
+// error, so we explain.
+func aclerror(bucket string, resp *http.Response) error {
+	err := statuserror(resp)
+	if resp.StatusCode == 400 && strings.Contains(strings.ToLower(err.Error()), "uniform bucket-level access") {
+		return fmt.Errorf("bucket %s has uniform bucket-level access enabled, acls are disabled and access is managed with IAM only (disable with \"cloudstream uniformaccess off /%s\"): %s", bucket, bucket, err)
+	}
+	return err
+}
+
+func publicaccessprevention(args []string) {
+	if len(args) != 2 {
+		usage()
+	}
+	bucket := bucketarg(args[1])
+	var err error
+	switch args[0] {
+	case "enforce", "inherited":
+		value := "inherited"
+		if args[0] == "enforce" {
+			value = "enforced"
+		}
+		body := map[string]interface{}{"iamConfiguration": map[string]string{"publicAccessPrevention": value}}
+		err = jsonrequest("PATCH", "/b/"+bucket, body, nil)
+	case "status":
+		var b struct {
+			IamConfiguration struct {
+				PublicAccessPrevention string `json:"publicAccessPrevention"`
+			} `json:"iamConfiguration"`
+		}
+		err = jsonrequest("GET", "/b/"+bucket+"?fields=iamConfiguration", nil, &b)
+		if err == nil {
+			fmt.Println(b.IamConfiguration.PublicAccessPrevention)
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+}
+
+func iam(args []string) {
+	fs := flag.NewFlagSet("iam", flag.ExitOnError)
+	fs.Usage = usage
+	force := fs.Bool("force", false, "set the policy even without etag, overwriting any concurrent change")
+	args = parseflags(fs, args)
+	if len(args) != 2 || (*force && args[0] != "set") {
+		usage()
+	}
+	bucket := bucketarg(args[1])
+	switch args[0] {
+	case "get":
+		var policy json.RawMessage
+		if err := jsonrequest("GET", "/b/"+bucket+"/iam", nil, &policy); err != nil {
+			fail(err.Error())
+		}
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, policy, "", "\t"); err != nil {
+			fail(err.Error())
+		}
+		buf.WriteString("\n")
+		os.Stdout.Write(buf.Bytes())
+	case "set":
+		buf, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fail(err.Error())
+		}
+		var policy struct {
+			Etag string `json:"etag"`
+		}
+		if err := json.Unmarshal(buf, &policy); err != nil {
+			fail("parsing policy: " + err.Error())
+		}
+		if policy.Etag == "" && !*force {
+			fail("policy has no etag, use a policy from \"iam get\", or -force")
+		}
+		err = jsonrequest("PUT", "/b/"+bucket+"/iam", json.RawMessage(buf), nil)
+		if iserrorstatus(err, 412) {
+			fail("policy was changed after it was read, get it and apply your change again")
+		} else if err != nil {
+			fail(err.Error())
+		}
+	default:
+		usage()
+	}
+}
+
+type createbucketconfig struct {
+	XMLName            xml.Name `xml:"CreateBucketConfiguration"`
+	LocationConstraint string   `xml:",omitempty"`
+	StorageClass       string   `xml:",omitempty"`
+}
+
+func mkbucket(args []string) {
+	fs := flag.NewFlagSet("mkbucket", flag.ExitOnError)
+	fs.Usage = usage
+	location := fs.String("location", "", "location of the bucket, e.g. EU, US or europe-west4, default US")
+	class := fs.String("class", "", "default storage class for new files, e.g. STANDARD, NEARLINE, COLDLINE or ARCHIVE")
+	project := fs.String("project", config.Project, "project to create the bucket in, default the project of the hmac key")
+	args = parseflags(fs, args)
+	if len(args) != 1 {
+		usage()
+	}
+	bucket := bucketarg(args[0])
+
+	var body io.Reader
+	if *location != "" || *class != "" {
+		buf, err := xml.Marshal(createbucketconfig{LocationConstraint: strings.ToUpper(*location), StorageClass: strings.ToUpper(*class)})
+		if err != nil {
+			fail(err.Error())
+		}
+		body = bytes.NewReader(buf)
+	}
+	var header http.Header
+	if *project != "" {
+		header = http.Header{"x-goog-project-id": {*project}}
+	}
+	resp, err := request("PUT", "/"+bucket, header, body)
+	if err != nil {
+		fail(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 409 {
+		fail(fmt.Sprintf("bucket %s already exists, bucket names are global, they may be in use by someone else", bucket))
+	} else if resp.StatusCode != 200 {
+		fail(statuserror(resp).Error())
+	}
+	io.Copy(io.Discard, resp.Body)
+}
+
+func rmbucket(args []string) {
+	fs := flag.NewFlagSet("rmbucket", flag.ExitOnError)
+	fs.Usage = usage
+	force := fs.Bool("force", false, "first remove the files still in the bucket")
+	concurrency := fs.Int("concurrency", 4, "number of files to remove at a time with -force")
+	args = parseflags(fs, args)
+	if len(args) != 1 {
+		usage()
+	}
+	bucket := bucketarg(args[0])
+
+	if *force {
+		var files []syncfile
+		err := listobjects(bucket, "", "", "", func(l []objectinfo, marker string) error {
+			for _, o := range l {
+				files = append(files, syncfile{Name: o.Name, Size: o.Size, Op: "delete-remote", Generation: o.Generation})
+			}
+			return nil
+		})
+		if err != nil {
+			fail(fmt.Sprintf("listing %s: %s", bucket, err))
+		}
+		failed, skipped := runall(files, *concurrency, "fail", func(f syncfile) error {
+			// A file that was removed in the meantime is fine, a file that was
+			// replaced keeps the bucket from being removed.
+			var header http.Header
+			if googlestorage() {
+				header = http.Header{"x-goog-if-generation-match": {fmt.Sprintf("%d", f.Generation)}}
+			}
+			err := deleteobject(f.Name, header)
+			if iserrorstatus(err, 404) {
+				err = nil
+			}
+			return err
+		})
+		checkfailed(failed, skipped, len(files))
+	}
+
+	resp, err := request("DELETE", "/"+bucket, nil, nil)
+	if err != nil {
+		fail(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 409 {
+		msg := "bucket is not empty"
+		if *force {
+			msg += ", files were added while removing, or old versions of files remain, see versioning"
+		} else {
+			msg += ", see -force"
+		}
+		fail(msg)
+	} else if resp.StatusCode != 204 && resp.StatusCode != 200 {
+		fail(statuserror(resp).Error())
+	}
+}
+
+// Result of GET Service.
+type bucketlist struct {
+	Buckets struct {
+		Bucket []struct {
+			Name         string
+			CreationDate time.Time
+		}
+	}
+}
+
+func buckets(args []string) {
+	fs := flag.NewFlagSet("buckets", flag.ExitOnError)
+	fs.Usage = usage
+	project := fs.String("project", config.Project, "project to list the buckets of, default the project of the hmac key")
+	args = parseflags(fs, args)
+	if len(args) != 0 {
+		usage()
+	}
+	var header http.Header
+	if *project != "" {
+		header = http.Header{"x-goog-project-id": {*project}}
+	}
+	resp, err := request("GET", "/", header, nil)
+	if err != nil {
+		fail(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		fail(statuserror(resp).Error())
+	}
+	var l bucketlist
+	if err := xml.NewDecoder(resp.Body).Decode(&l); err != nil {
+		fail("parsing bucket list: " + err.Error())
+	}
+	for _, b := range l.Buckets.Bucket {
+		fmt.Printf("%20s /%s\n", b.CreationDate.UTC().Format(time.RFC3339), b.Name)
+	}
+}
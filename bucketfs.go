@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files under a prefix as a file system, for serving them over WebDAV
+// and SFTP.  Names are slash-separated, relative to the prefix.
+// Slashes in object names separate directories.  Cloud storage has no
+// directories, those made with mkdir only exist in memory until they
+// have files.  Moves are copies within cloud storage followed by
+// removal.
+type bucketfs struct {
+	prefix string // "/bucket/" or "/bucket/prefix/".
+
+	sync.Mutex
+	made map[string]bool // Paths of directories made with mkdir, with trailing slash.
+}
+
+// Object path for name.  The path for the root ends with a slash.
+func (b *bucketfs) path(name string) string {
+	return b.prefix + strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (b *bucketfs) stat(name string) (bucketinfo, error) {
+	p := b.path(name)
+	if p == b.prefix {
+		return bucketinfo{name: "/", dir: true}, nil
+	}
+	h, err := headwith(p, acceptgzip(nil))
+	if err == nil {
+		size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		if err != nil {
+			return bucketinfo{}, errors.New("bad content-length of remote file")
+		}
+		modified, _ := http.ParseTime(h.Get("Last-Modified"))
+		return bucketinfo{name: path.Base(p), size: size, modified: modified, etag: h.Get("ETag"), contenttype: h.Get("Content-Type")}, nil
+	} else if !iserrorstatus(err, http.StatusNotFound) {
+		return bucketinfo{}, err
+	}
+	b.Lock()
+	dir := b.made[p+"/"]
+	b.Unlock()
+	if !dir {
+		if dir, err = hasfiles(p + "/"); err != nil {
+			return bucketinfo{}, err
+		}
+	}
+	if dir {
+		return bucketinfo{name: path.Base(p), dir: true}, nil
+	}
+	return bucketinfo{}, os.ErrNotExist
+}
+
+// Whether there are files under the prefix p, a directory.
+func hasfiles(p string) (bool, error) {
+	bucket, prefix := splitpath(p)
+	found := errors.New("found")
+	err := listobjects(bucket, prefix, "/", "", func(l []objectinfo, marker string) error {
+		if len(l) > 0 {
+			return found
+		}
+		return nil
+	})
+	if err == found {
+		return true, nil
+	}
+	return false, err
+}
+
+// Paths of the files under the prefix p, a directory.
+func listfiles(p string) ([]string, error) {
+	bucket, prefix := splitpath(p)
+	var l []string
+	err := listobjects(bucket, prefix, "", "", func(ol []objectinfo, marker string) error {
+		for _, o := range ol {
+			l = append(l, o.Name)
+		}
+		return nil
+	})
+	return l, err
+}
+
+// Files and directories in directory name.
+func (b *bucketfs) readdir(name string) ([]os.FileInfo, error) {
+	dir := strings.TrimSuffix(b.path(name), "/") + "/"
+	bucket, prefix := splitpath(dir)
+	l := []os.FileInfo{}
+	seen := map[string]bool{}
+	err := listobjects(bucket, prefix, "/", "", func(ol []objectinfo, marker string) error {
+		for _, o := range ol {
+			name := strings.TrimSuffix(strings.TrimPrefix(o.Name, dir), "/")
+			// Objects named like the directory, created by other tools, are skipped.
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			l = append(l, bucketinfo{name: name, size: o.Size, modified: o.Modified, etag: o.ETag, dir: o.Prefix})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.Lock()
+	defer b.Unlock()
+	for k := range b.made {
+		name := strings.TrimSuffix(strings.TrimPrefix(k, dir), "/")
+		if strings.HasPrefix(k, dir) && name != "" && !strings.Contains(name, "/") && !seen[name] {
+			seen[name] = true
+			l = append(l, bucketinfo{name: name, dir: true})
+		}
+	}
+	return l, nil
+}
+
+// Make directory name, its parent must exist.
+func (b *bucketfs) mkdir(name string) error {
+	if _, err := b.stat(name); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := b.stat(path.Dir(path.Clean("/" + name))); err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.made == nil {
+		b.made = map[string]bool{}
+	}
+	b.made[b.path(name)+"/"] = true
+	return nil
+}
+
+// Remove file name.
+func (b *bucketfs) remove(name string) error {
+	p := b.path(name)
+	if p == b.prefix {
+		return os.ErrPermission
+	}
+	err := deleteobject(p, nil)
+	if iserrorstatus(err, http.StatusNotFound) {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// Remove directory name, if it has no files.
+func (b *bucketfs) rmdir(name string) error {
+	p := b.path(name)
+	if p == b.prefix {
+		return os.ErrPermission
+	}
+	if nonempty, err := hasfiles(p + "/"); err != nil {
+		return err
+	} else if nonempty {
+		return errors.New("directory not empty")
+	}
+	b.Lock()
+	defer b.Unlock()
+	delete(b.made, p+"/")
+	return nil
+}
+
+// Remove name, a file, or a directory with all files under it.
+func (b *bucketfs) removeall(name string) error {
+	p := b.path(name)
+	if p == b.prefix {
+		return os.ErrPermission
+	}
+	if err := deleteobject(p, nil); err != nil && !iserrorstatus(err, http.StatusNotFound) {
+		return err
+	}
+	l, err := listfiles(p + "/")
+	if err != nil {
+		return err
+	}
+	for _, fp := range l {
+		if err := deleteobject(fp, nil); err != nil && !iserrorstatus(err, http.StatusNotFound) {
+			return err
+		}
+	}
+	b.Lock()
+	defer b.Unlock()
+	for k := range b.made {
+		if strings.HasPrefix(k, p+"/") {
+			delete(b.made, k)
+		}
+	}
+	return nil
+}
+
+// Move file or directory oldname to newname.
+func (b *bucketfs) rename(oldname, newname string) error {
+	src, dst := b.path(oldname), b.path(newname)
+	if src == b.prefix || dst == b.prefix {
+		return os.ErrPermission
+	}
+	fi, err := b.stat(oldname)
+	if err != nil {
+		return err
+	}
+	if !fi.dir {
+		if err := copyobject(src, dst, nil, true, false); err != nil {
+			return err
+		}
+		return deleteobject(src, nil)
+	}
+	l, err := listfiles(src + "/")
+	if err != nil {
+		return err
+	}
+	for _, fp := range l {
+		if err := copyobject(fp, dst+"/"+strings.TrimPrefix(fp, src+"/"), nil, true, false); err != nil {
+			return err
+		}
+		if err := deleteobject(fp, nil); err != nil {
+			return err
+		}
+	}
+	b.Lock()
+	defer b.Unlock()
+	for k := range b.made {
+		if strings.HasPrefix(k, src+"/") {
+			delete(b.made, k)
+			b.made[dst+"/"+strings.TrimPrefix(k, src+"/")] = true
+		}
+	}
+	return nil
+}
+
+// File info of a file or directory in a bucketfs.
+type bucketinfo struct {
+	name        string
+	size        int64
+	modified    time.Time
+	etag        string
+	contenttype string
+	dir         bool
+}
+
+func (fi bucketinfo) Name() string       { return fi.name }
+func (fi bucketinfo) Size() int64        { return fi.size }
+func (fi bucketinfo) ModTime() time.Time { return fi.modified }
+func (fi bucketinfo) IsDir() bool        { return fi.dir }
+func (fi bucketinfo) Sys() interface{}   { return nil }
+
+func (fi bucketinfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
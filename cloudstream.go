@@ -1,11 +1,11 @@
 /*
 Cloudstream is a command to stream files from/to Google Cloud Storage, e.g. for reading and writing backups.
 
-For now, the command "cloudstream" can only read and write files.
-It has no special knowledge about buckets, and no abilities to
-list directories or remove files.
+The command "cloudstream" reads and writes files, and has a few
+commands for keeping backups in order: listing files, verifying
+their integrity, and periodically scrubbing them in daemon mode.
 
-To use, first you must create a configuration file called
+To use, first create a configuration file called
 "cloudstream.conf", in the current working directory or in a directory
 higher up:
 
@@ -15,44 +15,898 @@ higher up:
 You can find these parameters in the Google API's Console, under
 "Google Cloud Storage", under "Interopable Access".
 
+Instead of an HMAC key, a service account key can be used, e.g. where
+HMAC keys are not allowed:
+
+	serviceaccount /etc/cloudstream/backup-sa.json
+
+Requests are then authorized with an OAuth2 access token, fetched with
+the key and renewed before it expires.  The token is also used for
+operations that need the JSON API.
+
+Without HMAC key, service account or token command, e.g. without
+configuration file, application default credentials are used: the
+JSON key file in $GOOGLE_APPLICATION_CREDENTIALS, the credentials of
+"gcloud auth application-default login", or on GCE and GKE, the
+service account of the instance through the metadata server.
+
+A configuration file can hold several accounts, as profiles:
+
+	accesskey ABCDEF0123456789
+	secret long-secret-provided-by-google
+
+	profile offsite {
+		accesskey GHIJKL0123456789
+		secret other-secret
+	}
+
+A profile is selected with "-profile name" before the command, e.g.
+"cloudstream -profile offsite put /offsite/backup.tar", or with
+$CLOUDSTREAM_PROFILE.  The lines of the profile are applied after the
+lines outside profiles, and override them.
+
+Other S3-compatible servers, like MinIO, Ceph RGW or Wasabi, are used
+by setting their endpoint, in the configuration file or a profile, or
+with "-endpoint url" before the command:
+
+	endpoint https://minio.example.com:9000
+	addressing path
+
+With addressing "path" (the default), the bucket is the first element
+of the path in the url, with "virtual" it is part of the host name,
+e.g. https://mybucket.minio.example.com:9000/.  Paths can be written
+as "s3://mybucket/name" then.  Without an endpoint, s3:// paths
+select AWS S3, at s3.amazonaws.com, or the endpoint of the configured
+region, e.g. s3.eu-west-1.amazonaws.com.  Features of Google Cloud
+Storage, like the JSON API, resumable uploads and preconditions on
+generations, are not available on other servers.
+
+Backblaze B2 is used through its S3-compatible API, with an
+application key and the endpoint of the region of the bucket, e.g. in
+a profile:
+
+	profile b2 {
+		accesskey 004a1b2c3d4e5f60000000001
+		secret K004abcdefghijklmnopqrstuvwxyz0
+		endpoint https://s3.us-west-004.backblazeb2.com
+	}
+
+The region, us-west-004, is taken from the endpoint.
+
+S3 does not accept uploads of unknown size, so put streams data to
+other servers with a multipart upload, in parts of 16MB, 4 at a time.
+Parts are kept in memory while uploading.  The part size and
+concurrency can be set in the configuration file, e.g. for larger
+files, S3 allows up to 10000 parts:
+
+	partsize 64M
+	partconcurrency 8
+
+Or with -part-size and -part-concurrency on put.
+
 Now you can write a file:
+
 	echo 'hi there!' | cloudstream put /mybucket/greeting.txt
 
 And you can read it back again:
+
 	cloudstream get /mybucket/greeting.txt
 
+Get compares the crc32c and md5 of the downloaded data with those of
+the remote file, and exits with an error on a mismatch.  Files
+uploaded as composite have only a crc32c.  On servers other than Google
+Cloud Storage, the ETag is used as md5, only for files not uploaded in
+parts.  When data is written to stdout, it has already gone out by the
+time the mismatch is found, so check the exit status.  Partial reads
+with -offset are not verified, and -no-verify turns verification off,
+e.g. for servers with ETags that are not an md5.
+
+New files get a Content-Type by the extension of the name, e.g.
+text/html for .html, or else by the first bytes of the data, as
+browsers do.  Set it explicitly with -content-type.  Files written
+through filters, e.g. encrypted, are stored as
+application/octet-stream:
+
+	cloudstream put -content-type text/csv /mybucket/export <export.dat
+
+Custom metadata is added with -meta, e.g. to record where a backup
+came from.  Stat shows it:
+
+	pg_dump db1 | cloudstream put -meta backup-set=2014-06-01 -meta host=db1 /mybucket/db1.dump
+
+With -public, the file gets the public-read acl, for publishing, e.g.
+release artifacts.  Anyone can then read it at
+https://storage.googleapis.com/bucket/name.  Buckets with uniform
+bucket-level access reject the acl:
+
+	cloudstream put -public /mybucket/release/tool-1.2.tar.gz <tool-1.2.tar.gz
+
+With -gzip, put compresses the data with gzip and stores it with
+Content-Encoding gzip.  Unlike with the gzip filter, other clients, like
+browsers and gsutil, decompress the file too.  Get decompresses it,
+unless -raw is set:
+
+	cloudstream put -gzip /mybucket/access.log </var/log/access.log
+
+Uploads send the crc32c and md5 of the data along, for the server to
+reject corrupted data instead of storing it: for files, for the final
+chunk of resumable uploads (started in the same run), and for each part
+of composite and multipart uploads.  A single-request upload of a
+stream, of unknown hashes, relies on TCP and TLS checksums.
+
+Paths can also be written as URIs, as with gsutil, e.g.
+"gs://mybucket/greeting.txt".
+
+With -if-not-exists, put only creates new files, it will never
+overwrite an existing file.  Useful for backups with immutable names.
+With -if-generation-match, put only replaces the file if it is still
+at the generation given, e.g. as printed by stat before, so concurrent
+jobs don't overwrite each other's files.  Generation 0 only matches if
+the file does not exist, like -if-not-exists.  If the precondition fails,
+put (and cp) exit with status 4, instead of 1 for other errors.
+With -expect-size, put aborts the upload if stdin does not provide
+exactly that many bytes, catching truncated dumps.  Sizes can have
+a suffix k, M, G or T.
+
+Transfers can be time-boxed with -max-duration, e.g. "-max-duration 8h".
+When the time is up, put stops after the current chunk of its
+resumable upload, and get stops reading.  Both print the command to
+continue the transfer later, with "put -resume url" and "get -offset
+n".  Exit status is 3 in this case.
+
+With -resumable, put uses the resumable upload protocol, also used
+for -max-duration, so a long upload survives network errors: the data
+is sent in chunks of 8MB, and after a failed chunk, put asks cloud
+storage how much data it received, and continues from there.  A chunk
+is tried up to 5 more times.  For -max-duration and -resume, uploads
+are always resumable.
+
+Get writes to a file instead of stdout with -o.  A non-empty existing
+file is not overwritten.  An interrupted download to a file is
+continued with -resume, which requests the data after the size of the
+partial file, and verifies the hashes of the complete file:
+
+	cloudstream get -o backup.tar -resume /mybucket/backup.tar
+
+If the remote file was replaced since the partial download, get fails
+instead of mixing versions.  Filtered files can only be resumed with
+-raw.
+
+With -progress, put and get print the number of bytes transferred and
+the throughput to stderr, and if the size is known, the percentage and
+estimated time left.  On a terminal, the line is updated every second,
+otherwise a line is printed every 30 seconds.
+
+Put can read from an http(s) url instead of stdin, with -from-url,
+e.g. for migrating data without using local disk space.  With
+-concurrency n, n ranged requests are made to the source at a time,
+if it supports them.
+
+With -r, put uploads the files in a local directory, each to a file
+with its relative path under the prefix, e.g.:
+
+	cloudstream put -r /var/backups /mybucket/db1/
+
+Filters and -if-not-exists apply to each file.  Files are uploaded
+-concurrency at a time.  With "-on-error fail", no new uploads are
+started after a failure, with "continue" (the default) the remaining
+files are still uploaded.  Either way, the exit status is 1 if a file
+failed.
+
+Get -r is the reverse, it downloads all files under a prefix into a
+local directory, creating directories as needed, and reversing
+filters:
+
+	cloudstream get -r /mybucket/db1/ /var/restore
+
+For files that are not in a single directory, batch reads operations
+from stdin, one per line, and executes them -concurrency at a time
+(default 8), in one process:
+
+	put localpath path
+	get path localpath
+	cp src dst
+	rm path
+
+Words are separated by white space, names with spaces are
+double-quoted, with backslash escapes as in Go.  Empty lines and lines
+starting with # are ignored.  Operations are executed in no particular
+order, an operation must not depend on another in the same batch.
+Filters apply to put, and are reversed for get.  Each completed
+operation is printed, and -on-error works as for put -r:
+
+	find /data -name '*.log' -mtime +7 | sed 's,.*,put & /mybucket&,' | cloudstream batch
+
+Downloads are also limited by a single stream.  With -concurrency n,
+get fetches a large file with n ranged requests of 8MB at a time, and
+writes the data in order, keeping at most n parts in memory:
+
+	cloudstream get -concurrency 8 /mybucket/data.tar | tar x
+
+A single upload stream is limited to a few hundred Mbit/s.  To fill
+faster links, "put -composite" reads the data in parts, by default of
+16MB, uploads -part-concurrency parts at a time (default 4) as
+temporary files, and composes them into the file:
+
+	tar c /data | cloudstream put -composite -part-size 64M -part-concurrency 16 /mybucket/data.tar
+
+Composite files have a crc32c hash, but no md5.  If the upload fails,
+the temporary files are removed.
+
+Files uploaded separately, e.g. chunks uploaded from different machines,
+are merged within cloud storage with compose.  The files must be in the
+bucket of the destination, which can be one of the files, appending to
+it.  More than 32 files are composed in steps, through temporary files.
+With -rm, the files are removed after composing:
+
+	cloudstream compose -rm /mybucket/data.tar.1 /mybucket/data.tar.2 /mybucket/data.tar
+
+With "put -append", the data is added to the end of the file, creating
+it if it does not exist.  The data is uploaded as a temporary file and
+composed onto the file, with the generation of the file as
+precondition: if another process appended in between, put fails with
+exit status 4.  Data read so far is appended every -append-interval
+(default 10s) and every part size, for shipping logs:
+
+	tail -F /var/log/app.log | cloudstream put -append /mybucket/logs/app.log
+
+Every append is a new generation of the file, with versioning enabled
+all are kept.  Appending does not work with filters or -gzip.
+
+With "put -tee", the data read is also written to stdout, as is, before
+filters.  Put can be placed in the middle of a pipeline, without
+reading the source twice:
+
+	pg_dump mydb | cloudstream put -tee /mybucket/mydb.sql | sha256sum
+
+If writing to stdout fails, the upload is aborted.
+
+Large files can be stored in parts, described by a manifest, a JSON
+file listing the parts with their sizes and hashes.  "get -joined"
+reads a manifest and writes the original file, fetching parts with
+-concurrency requests at a time, and checking each part against its
+hashes.
+
+With "put -split size", put writes the data in files of at most size
+bytes, named like the file with suffixes .000, .001, etc., and a
+manifest at the path of the file.  For data larger than the maximum
+size of a file, e.g. with some S3-compatible servers.  Filters are
+applied to the data as a whole.  If an upload fails, stored parts are
+removed:
+
+	pg_dump db1 | cloudstream put -split 50G -compress zstd /mybucket/db1.dump
+	cloudstream get -joined /mybucket/db1.dump | pg_restore -d db1
+
+Requests that fail with a network error, a server error or rate
+limiting are tried again, up to 5 times, with exponentially growing,
+randomized delays of up to about 32 seconds.  The number of tries is
+set with e.g. "retries 10" in the configuration file.  Uploads of
+streams cannot be sent again, use -resumable for long uploads.
+
+Requests are signed with the current time.  If cloud storage rejects
+a request because the local clock is too far off, cloudstream adopts
+the time of the server for the rest of the run, and retries.
+
+Requests to Google Cloud Storage are signed with the legacy V2 scheme
+by default, requests to other endpoints with AWS Signature Version 4.
+Either can be selected in the configuration file:
+
+	signature v4
+	region auto
+
+The region defaults to "auto" for Google Cloud Storage.  For other
+endpoints, it is taken from host names like
+s3.eu-west-1.amazonaws.com, and is us-east-1 otherwise.  Request
+bodies are sent as UNSIGNED-PAYLOAD, they are not hashed beforehand.
+
+The bandwidth used by cloudstream can be limited by time of day, with
+lines in the configuration file:
+
+	bandwidth 08:00-18:00 5M
+	bandwidth 22:00-06:00 unlimited
+	bandwidth 20M
+
+Rates are in bytes per second.  The first line with a window that
+contains the current time applies, a line without window applies all
+day.  Without matching line, bandwidth is unlimited.  The limit is for
+all transfers together, and follows the windows during long
+transfers, e.g. in daemon mode.
+
+For a single run, "-limit-rate rate" before the command replaces the
+bandwidth lines of the configuration file, e.g. "cloudstream
+-limit-rate 20M put /mybucket/backup.tar".  Rate "unlimited" removes
+the limit.
+
+# Encryption and filters
+
+Data can be encrypted client-side, with "put -key-file file".  The
+file holds a master key, 32 random bytes, base64-encoded:
+
+	head -c 32 /dev/urandom | base64 >cloudstream.key
+
+Each file gets its own data key, wrapped with the master key and
+stored in the file's metadata.  Get recognizes encrypted files,
+and decrypts them as a stream when given the same -key-file, so
+restores can be piped straight into e.g. tar or psql.
+
+Instead of a key file, the master key can be derived from a
+passphrase, with argon2id.  The passphrase is read from a file with
+-passphrase-file, from a file descriptor with -passphrase-fd, or
+prompted for on the terminal with -passphrase.  The argon2id
+parameters and salt are stored in the file's metadata.
+
+The data is encrypted in authenticated frames, so corruption and
+truncation are detected.  The cipher is AES-256-GCM, or
+XChaCha20-Poly1305 with "-cipher xchacha20-poly1305".
+
+Alternatively, data is encrypted with age, to recipients given with
+-encrypt-to, as age1... public keys or files with one per line.  The
+machine making backups only needs the public keys, the identity to
+decrypt is kept elsewhere until a restore.  The stored data is an age
+file, other age tools can decrypt it too:
+
+	pg_dump db1 | cloudstream put -encrypt-to age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p /mybucket/db1.dump
+	cloudstream get -identity key.txt /mybucket/db1.dump | pg_restore -d db1
+
+Cloud storage can also encrypt files with a key that only you hold,
+a customer-supplied encryption key, given with -csek-key as 32
+bytes, base64-encoded.  Cloud storage does not store the key, so put,
+get and cp need it for the file.  Cp with -source-csek-key and
+-csek-key rewraps a file with a new key, within cloud storage:
+
+	head -c 32 /dev/urandom | base64 >csek.key
+	cloudstream put -csek-key "$(cat csek.key)" /mybucket/backup.tar <backup.tar
+	cloudstream cp -source-csek-key "$(cat csek.key)" -csek-key "$(cat new.key)" /mybucket/backup.tar /mybucket/backup.tar
+
+With -kms-key, cloud storage encrypts a new file with a key from Cloud
+KMS, instead of its default key.  A "kmskey" line in the configuration
+file sets the key for all uploads, e.g. to enforce the use of your own
+keys.  Reading the file needs no extra flags, only permission to use
+the key.  On S3-compatible servers, the key is an AWS KMS key id:
+
+	kmskey projects/p/locations/l/keyRings/r/cryptoKeys/k
+
+Keys can be rotated without transferring data.  The rekey command
+unwraps the data keys of files with the old master key, wraps them
+with a new one, and replaces only the metadata of the files:
+
+	cloudstream rekey -key-file old.key -new-key-file new.key /mybucket/backup.tar
+
+More generally, put passes the data through a pipeline of filters,
+set with -filters, or with a "filters" line in the configuration
+file.  For example, "-filters sha256,gzip:9,encrypt" appends a
+sha256 hash of the data, compresses with gzip level 9, then encrypts.
+The pipeline is stored in the file's metadata, and get reverses
+exactly what put did, verifying the hash.  Get -raw writes the data
+as stored.  Filters: gzip[:level], zstd[:level], encrypt[:cipher],
+age and sha256.
+
+Other programs can be plugged in with -filter-put, a shell command
+the data is passed through before the other filters.  The command is
+not stored, get needs the reverse with -filter-get, which runs after
+the other filters are reversed:
+
+	tar c /data | cloudstream put -filter-put 'gpg -e -r backup@example.com' /mybucket/data.tar.gpg
+	cloudstream get -filter-get 'gpg -d' /mybucket/data.tar.gpg | tar x
+
+Zstd compresses much faster than gzip, to keep up with fast dumps.
+With -compress, put adds a compression filter in front of the
+others, e.g. with encryption:
+
+	pg_dump db1 | cloudstream put -compress zstd:3 -key-file backup.key /mybucket/db1.dump
+
+# Archives
+
+Directory trees with many small files are slow to upload as a file
+each, and each costs a request.  Put-tar uploads a directory as a
+single tar file instead, made while uploading, without a local copy.
+Directories, regular files and symlinks are stored, with their
+permissions and modification times.  The flags for compression and
+encryption are those of put:
+
+	cloudstream put-tar -compress zstd -key-file backup.key /home /mybucket/home-2014-06-01.tar
+
+Get-tar extracts a tar file while downloading, reversing the filters,
+and restoring permissions and modification times, and owners when
+run as root.  Any tar file can be extracted, not only those made by
+put-tar.  Names pointing outside the directory are an error:
+
+	cloudstream get-tar -key-file backup.key /mybucket/home-2014-06-01.tar /restore
+
+# Holds
+
+With "put -temporary-hold", a temporary hold is placed on a file right
+after it is uploaded.  A held file cannot be deleted or replaced, e.g.
+by lifecycle rules pruning old backups, so a backup set that is still
+being written stays intact.  Release the holds when the set is
+complete and verified:
+
+	cloudstream hold -release /mybucket/set1/a.tar /mybucket/set1/b.tar
+
+Holds are managed through the JSON API, which needs an OAuth2 access
+token instead of the HMAC key.  Configure a service account, see
+above, or a command printing a token:
+
+	tokencommand gcloud auth print-access-token
+
+# Copying
+
+Files are copied within cloud storage, without transferring the data:
+
+	cloudstream cp /mybucket/latest.tar /mybucket/backup-2014-06-01.tar
+
+The copy gets fresh metadata, except for the metadata cloudstream
+needs to reverse filters.  With -preserve, Content-Type,
+Content-Encoding, Cache-Control, custom metadata and storage class
+of the source are carried over.  With -preserve-acl, the ACL is
+copied as well.  With -if-not-exists, the copy fails if the
+destination already exists, so dated backups are never overwritten.
+
+Mv renames a file, by copying it with its metadata, checking size and
+hashes of the copy, and only then removing the original.  If the
+original changed in the meantime, it is not removed.
+
+Files are removed with rm, e.g. for rotating backups.  With -f, files
+that don't exist are not an error:
+
+	cloudstream rm /mybucket/backup-2014-05-01.tar
+
+Metadata can be changed without transferring data, by copying a file
+onto itself.  Setmeta changes Content-Type, Cache-Control and custom
+metadata, rewrite changes the storage class:
+
+	cloudstream setmeta -meta host=db1 -content-type application/x-tar /mybucket/backup.tar
+	cloudstream rewrite -storage-class COLDLINE /mybucket/backup.tar
+
+The custom time of a file, which lifecycle rules can use to age out
+backups, is set with -custom-time on put or setmeta, in RFC3339 format,
+e.g. "-custom-time 2014-06-01T00:00:00Z".  Stat shows it, and ls with
+-custom-time, at the cost of a request per file.
+
+# Listing and verifying
+
+To show the attributes of a file, like size, etag, times, hashes and
+custom metadata:
+
+	cloudstream stat /mybucket/backup.tar
+
+Stat, or head, exits with status 1 if a file does not exist, so
+scripts can check whether an upload landed.
+
+To list files:
+
+	cloudstream ls /mybucket/backups/
+
+Ls, or list, lists one "directory" level, with -r it lists all files
+under the prefix.  With -l, size and modification time are printed
+too.  With -json-lines, each file is printed as a JSON object on
+its own line, with name, size, modification time, etag, generation
+and storage class.  Listings are written as they are fetched, one
+page at a time, so even huge buckets can be listed with little memory.
+With -checkpoint file, the position in the listing is saved to the
+file after each page.  After an interruption, the same command
+continues where it left off.  The file is removed when done.
+
+To see how much is stored under a prefix:
+
+	cloudstream du -d -h /mybucket/backups/
+
+Du prints the bytes and number of files under the prefix, with -d also
+for each directory directly under the prefix, and with -h sizes with a
+unit.  With -a, old versions in a versioned bucket are counted too.
+With -checkpoint, du continues after an interruption, like ls.
+
+To find files by age, size or name:
+
+	cloudstream find -older-than 90d -name '*.tar.zst' /mybucket/backups/
+
+Find prints the paths of files under the prefix matching all of
+-newer-than, -older-than (durations, with d for days), -larger-than,
+-smaller-than (sizes) and -name (a pattern for the part after the last
+slash), with -l also the size and modification time.  With -batch rm,
+or -batch get and -batch-dir localdir, find prints operations for
+batch instead, with names quoted as needed, e.g. to remove the files
+found:
+
+	cloudstream find -older-than 90d -batch rm /mybucket/backups/ | cloudstream batch
+
+Stored data can be checked for bit rot with verify:
+
+	cloudstream verify -remote-only /mybucket/backups/
+
+All files under the prefix are downloaded, a few at a time (see
+-concurrency), and their crc32c and md5 hashes are compared with
+the hashes google stored.  Without -remote-only, verify compares
+the stored hashes against those of files in a local directory.
+A line is printed for each file, or a JSON object with -json-lines.
+Exit status is 1 if a file did not verify.
+
+# Syncing
+
+"cloudstream sync" uploads the files of a local directory that are
+new or changed:
+
+	cloudstream sync /var/backups /mybucket/backups/
+
+To download instead, give the remote path first, as gs:// URI, or
+s3:// with an S3-compatible endpoint:
+
+	cloudstream sync gs://mybucket/backups/ /var/restore
+
+Downloaded files get the modification time of the remote file, and
+are written to a temporary file first, replacing the local file only
+when complete.
+
+Files with a different size are changed.  Files modified after the
+last upload are hashed, and only uploaded if the hash differs from
+the sha256 that sync stores in the metadata, or for files uploaded
+otherwise, the md5 stored by cloud storage, or the crc32c for files
+without md5, like composite files.  A new mtime alone does not cause
+an upload.  This is "-compare size+mtime".  With "-compare size",
+only the size is compared.  With "-compare checksum", the hash of
+each file is compared, with a request per file, for when mtimes
+cannot be trusted, e.g. after restoring from an archive that did not
+keep them.  Only files with different contents are transferred.
+Digests of local files are cached, in -digest-cache, so unmodified
+files are not hashed again.
+
+Listing a prefix with millions of files takes a while.  With
+-list-cache file, the listing is kept in file, and used instead of
+listing again for -list-cache-ttl, default an hour.  Changes made by
+sync are applied to the kept listing, changes made by others are only
+seen after the listing expires.
+
+With -delete, files that are not present on the source side are
+removed from the destination.  With -backup-dir, remote files are
+copied within cloud storage before they
+are overwritten or removed, to a prefix with the time of the sync, so
+mistakes can be undone:
+
+	cloudstream sync -delete -backup-dir /mybucket/.trash/ /var/backups /mybucket/backups/
+
+When a file fails, sync continues with the other files, and exits
+with status 1 at the end.  With "-on-error fail", sync stops starting
+on new files after the first failure.  With "-on-error retry-later",
+failed files are queued in the -state file, sync exits successfully,
+and the next run transfers the queued files again, even if they look
+unchanged.
+
+With -finalize, the prefix is a backup set that is only complete
+once a sync succeeded.  Before changing files, sync removes the marker
+file ".cloudstream-done" from the prefix.  After all files were
+transferred, sync verifies the size and sha256 of each file, and
+writes the marker again, listing the files.  "ls -finalized" only
+lists the sets with a marker, so half-written backups are ignored:
+
+	cloudstream sync -finalize /var/backups/today /mybucket/backups/20261014/
+	cloudstream ls -finalized /mybucket/backups/
+
+With -two-way, changes are propagated in both directions: new and
+changed files are downloaded too, and files removed on one side are
+removed on the other.  Changes are relative to the previous sync,
+whose state is kept in the -state file.  Files changed on both sides
+are conflicts, they are reported and left alone, unless -winner says
+which side wins: local, remote, or the newer file.  Transfers fail
+if the remote file changed after it was listed.
+
+With -concurrency n, n files are transferred at a time.  Large files
+are started first, on their own connections, while the other
+connections work through the small files, so the sync isn't held up
+by a single large file at the end.
+
+# Buckets
+
+Buckets are created with mkbucket, optionally with a location and
+default storage class:
+
+	cloudstream mkbucket -location EU -class NEARLINE /mybucket
+
+The bucket is created in the project of the HMAC key, or the project
+given with -project or the "project" line in the configuration file.
+
+Buckets lists the buckets in the project, with their creation time.
+
+Rmbucket removes an empty bucket.  With -force, the files in the
+bucket are removed first, e.g. for temporary buckets in tests.  Old
+versions of files are not removed, a bucket with versioning enabled
+may have to be cleaned up with lifecycle rules.
+
+Object versioning keeps the old version of a file when it is
+overwritten or removed:
+
+	cloudstream versioning on /mybucket
+
+"versioning off" suspends versioning, "versioning status" prints
+"enabled", "suspended", or "off" if versioning was never enabled.
+
+Old versions are listed with "ls -a", which prints names with their
+generation, e.g. "/mybucket/db1.dump#1401580800000000".  Stat shows the
+generation of the live version.  Get -generation fetches an old
+version, e.g. to restore after an accidental overwrite:
+
+	cloudstream ls -a /mybucket/db1.dump
+	cloudstream get -generation 1401580800000000 /mybucket/db1.dump >db1.dump
+
+Autoclass moves files between storage classes based on how they
+are accessed.  Enable it with "autoclass on /mybucket", optionally
+with "-terminal-class ARCHIVE" for the class files end up in (default
+NEARLINE).  Autoclass is configured through the JSON API, see
+tokencommand.
+
+New files in a bucket can be encrypted with a customer-managed key
+from Cloud KMS by default:
+
+	cloudstream defaultkms set projects/p/locations/l/keyRings/r/cryptoKeys/k /mybucket
+
+"defaultkms clear /mybucket" removes the default key, "defaultkms
+status /mybucket" prints it.
+
+With uniform bucket-level access, access to a bucket is managed
+with IAM only, and per-file ACLs are disabled.  Toggle it with
+"uniformaccess on|off /mybucket", also through the JSON API.
+Commands working with ACLs, like "cp -preserve-acl", explain when
+it is enabled.
+
+To make sure backups are never exposed publicly, whatever their
+ACLs or IAM policy:
+
+	cloudstream public-access-prevention enforce /mybucket
+
+"inherited" reverts to the organization policy.
+
+The IAM policy of a bucket is read and written as JSON, e.g. to grant
+a restore role:
+
+	cloudstream iam get /mybucket >policy.json
+	# edit policy.json
+	cloudstream iam set /mybucket <policy.json
+
+The policy contains an etag, and set fails if the policy was changed
+after it was read, so concurrent changes are not lost.  Set refuses
+policies without etag, unless -force is given.
+
+# HMAC keys
+
+The HMAC keys cloudstream signs with can be managed with cloudstream
+too, e.g. for rotating them.  Keys belong to service accounts in a
+project, set with -project or a "project" line in the configuration
+file.  Create prints the new key in the format of the configuration
+file:
+
+	cloudstream hmackey create backup@myproject.iam.gserviceaccount.com
+	cloudstream hmackey list
+	cloudstream hmackey deactivate GOOG1EXAMPLE
+	cloudstream hmackey delete GOOG1EXAMPLE
+
+Only inactive keys can be deleted.  Like other JSON API commands,
+hmackey needs a tokencommand.
+
+# Raw requests
+
+Parts of the API without a command of their own can be reached with
+"cloudstream raw", which signs and executes a request, and writes
+the response body to stdout:
+
+	cloudstream raw GET '/mybucket?lifecycle'
+	cloudstream raw -body -header 'content-type: application/xml' PUT '/mybucket?lifecycle' <lifecycle.xml
+
+With -i, the response status and headers are printed to stderr.
+The path is sent as given, special characters in object names must
+be percent-encoded.
+
+When requests fail with SignatureDoesNotMatch, "cloudstream sign"
+shows how a request is signed: the canonical resource and headers,
+the string to sign, and the resulting authorization header.  Without
+-dry-run it also executes the request, the error response contains
+the string to sign as computed by cloud storage, for comparison:
+
+	cloudstream sign -dry-run PUT /mybucket/file 'x-goog-meta-owner: me'
+
+To hand out a download link without sharing credentials, presign
+prints a signed url for a file, valid for -expires (default 1h):
+
+	cloudstream presign -expires 24h /mybucket/backup.tar
+
+Urls are signed with the HMAC key, or with the service account key.
+With signature version 4, urls expire within 7 days.
+
+With -method PUT, the url is for uploading a single file instead, e.g.
+from a machine without credentials.  With -content-type, the upload
+must be sent with that Content-Type:
+
+	cloudstream presign -method PUT -expires 2h /mybucket/host1.tar
+	curl -T host1.tar 'https://...'
+
+# Daemon
+
+"cloudstream daemon" runs the jobs from the configuration file,
+until killed.  For now, these are scrubs, verifying stored data
+against its hashes:
+
+	scrub /mybucket/backups/ 24h 0.1
+	scrubreports /mybucket/scrub-reports/
+	scrubhook /usr/local/bin/alert-admin
+
+This verifies a random 10% of the files under /mybucket/backups/
+every 24 hours.  Use 1 to verify all files.  After each scrub, a
+JSON report is written to the scrubreports prefix, by default
+".cloudstream/scrub/" in the scrubbed bucket.  If a file did not
+verify, the scrubhook command is run with the report path as
+parameter, and the report on stdin.
+
+# Serving
+
+"cloudstream serve" makes files available over http on a local
+address, without handing out the credentials:
+
+	cloudstream serve media -listen localhost:8081 /mybucket/videos/
+
+Files under the prefix are served with their url path as name.  Range
+requests are passed on to cloud storage, so media players can seek,
+and partial restores only fetch what they need.  Files are served as
+stored, filters are not reversed.
+
+A static website in a bucket can be previewed with "serve www":
+
+	cloudstream serve www /mybucket/site/
+
+Directories are served with their index document, and missing files
+with the not found page, as set in the website configuration of the
+bucket, or with -index (default index.html) and -notfound.  Files
+stored without content-type get one based on their extension.
+
+With "serve webdav", files can also be written, removed and moved,
+e.g. from a file manager, or tools that only speak WebDAV:
+
+	cloudstream serve webdav -listen localhost:8082 /mybucket/shared/
+
+Files are read as stored, and uploads are streamed to cloud storage,
+stored only when the whole request body was received.  Moves copy
+files within cloud storage, then remove the originals.  Anyone who can
+reach the address has access, with the credentials of cloudstream.
+
+To serve beyond the local machine, e.g. as a gateway in front of a
+private bucket, require http basic authentication with -auth, with a
+file of "user:password" lines.  Serve over https, e.g. through a
+reverse proxy, to keep the passwords secret:
+
+	cloudstream serve media -listen :9000 -auth passwords /mybucket/static/
+
+With "serve sftp", files are available over SFTP, for backup
+appliances and other tools that can only upload with SFTP.  Users log
+in with a public key, listed in the file of -user, like an OpenSSH
+authorized_keys file.  With -user-dirs, each user only has access to
+the directory with their name:
+
+	ssh-keygen -t ed25519 -N '' -f sftp-host-key
+	cloudstream serve sftp -listen :2022 -host-key sftp-host-key -user nas1=nas1.pub -user-dirs /mybucket/backups/
+
+Like with webdav, uploads are streamed to cloud storage, and stored
+when the client closes the file, not when the connection was lost.
+Files can only be written as a whole, not changed in place.
+
+# Mounting
+
+"cloudstream mount" makes files available as a local file system,
+with FUSE, until interrupted.  Slashes in names separate directories.
+Files are read with ranged requests, so looking into a large archive
+or database doesn't fetch all of it.  Files are read as stored,
+filters are not reversed:
+
+	cloudstream mount /mybucket/backups/ /mnt/backups
+	unzip -l /mnt/backups/2014-06-01/home.zip
+
+The mount is read-only by default.  With -rw, new files can be
+written and files removed.  Files are written sequentially, streamed
+to cloud storage as the data comes in, and stored when closed.
+Existing files can only be replaced as a whole, not changed in place.
+
+# Background
+
 This package uses the simple REST API from Amazon S3, but on Google
 Cloud Storage.  This keeps authentication bearable, and means the
 ugly automatically generated JSON-based API doesn't have to be used.
-Note that this library won't work on AWS S3.  S3 doesn't support
-streaming uploads with the "chunked" transfer-encoding.  To "stream"
-to S3, you have to fake it by uploading 5MB chunks of file.  Making
-it all a bit inconvenient to get decent transfer rates.
+S3 doesn't support streaming uploads with the "chunked"
+transfer-encoding.  To "stream" to S3, cloudstream fakes it with a
+multipart upload, uploading parts of the stream concurrently to get
+decent transfer rates.
 */
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
+	"bitbucket.org/mjl/cloudstream/objects"
 	"bitbucket.org/mjl/tokenize"
 )
 
 var config struct {
-	AccessKey string // AWS/Google access key, identifying account
-	Secret    string // For signing requests
+	AccessKey       string // AWS/Google access key, identifying account
+	Secret          string // For signing requests
+	Signature       string // "v2" or "v4", see sigv4.go, default v2 for Google, v4 for other endpoints
+	Region          string // For signature v4, default from endpoint
+	Endpoint        string // E.g. "https://minio.example:9000", default the Google endpoint
+	Addressing      string // "path" (default), or "virtual" for bucket in host name
+	PartSize        int64  // For multipart uploads to S3, default 16M
+	PartConcurrency int    // Parts uploaded at a time, default 4
+	Retries         int    // Times a failed request is tried again, -1 until configured for default 5
+	Filters         string // Default filter pipeline for put
+	KMSKey          string // Default Cloud KMS key for put
+
+	Scrubs       []scrubjob // For daemon
+	ScrubReports string     // Prefix for scrub reports, default .cloudstream/scrub/ in the bucket
+	ScrubHook    []string   // Command to run when a scrub found problems
+
+	TokenCommand   []string // Prints an OAuth2 access token, for the JSON API
+	ServiceAccount string   // JSON key file of a service account, for access tokens
+	Project        string   // Default project, e.g. for hmackey
+
+	Bandwidth []bandwidthwindow // Limits by time of day, first match applies.
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: cloudstream [put file | get file]\n")
+	lines := []string{
+		"cloudstream put [-progress] [-if-not-exists | -if-generation-match generation] [-expect-size size] [-max-duration duration] [-resume url] [-resumable] [-composite [-part-size size] [-part-concurrency n] | -split size | -append [-append-interval duration]] [-tee] [-from-url url [-concurrency n]] [encryption flags [-cipher name]] [-encrypt-to recipient ...] [-filter-put command] [-gzip | [-compress name[:level]] [-filters pipeline]] [-content-type type] [-meta key=value ...] [-custom-time time] [-temporary-hold] [-public] [-csek-key key | -kms-key name] path",
+		"cloudstream put -r [-if-not-exists] [-concurrency n] [-on-error continue|fail] [encryption flags [-cipher name]] [-encrypt-to recipient ...] [-filter-put command] [-gzip | [-compress name[:level]] [-filters pipeline]] [-content-type type] [-meta key=value ...] [-custom-time time] [-public] [-csek-key key | -kms-key name] localdir prefix",
+		"cloudstream put-tar [encryption flags [-cipher name]] [-encrypt-to recipient ...] [-compress name[:level]] [-filters pipeline] localdir path",
+		"cloudstream get [-progress] [-offset n | -o file [-resume]] [-max-duration duration] [encryption flags] [-identity file] [-filter-get command] [-raw] [-no-verify] [-concurrency n] [-joined] [-generation n] [-csek-key key] path",
+		"cloudstream get -r [-concurrency n] [-on-error continue|fail] [encryption flags] [-identity file] [-raw] [-no-verify] [-csek-key key] prefix localdir",
+		"cloudstream get-tar [encryption flags] [-identity file] path localdir",
+		"cloudstream batch [-concurrency n] [-on-error continue|fail] [encryption flags [-cipher name]] [-encrypt-to recipient ...] [-identity file] [-compress name[:level]] [-filters pipeline] <operations",
+		"cloudstream cp [-preserve] [-preserve-acl] [-if-not-exists] [-csek-key key] [-source-csek-key key] src dst",
+		"cloudstream compose [-content-type type] [-if-not-exists] [-rm] [-csek-key key] path ... dst",
+		"cloudstream mv [-preserve-acl] [-if-not-exists] src dst",
+		"cloudstream rm [-f] path ...",
+		"cloudstream setmeta [-content-type type] [-cache-control value] [-custom-time time] [-meta key=value ...] [-remove-meta key ...] path ...",
+		"cloudstream rewrite -storage-class class path ...",
+		"cloudstream stat|head path ...",
+		"cloudstream hold [-release] path ...",
+		"cloudstream ls|list [-r] [-l] [-a] [-json-lines] [-custom-time] [-checkpoint file] [-finalized] /bucket/[prefix]",
+		"cloudstream du [-d] [-h] [-a | -checkpoint file] /bucket/[prefix]",
+		"cloudstream find [-newer-than duration] [-older-than duration] [-larger-than size] [-smaller-than size] [-name pattern] [-l | -batch rm | -batch get -batch-dir localdir] /bucket/[prefix]",
+		"cloudstream verify [-concurrency n] [-json-lines] [-checkpoint file] (-remote-only /bucket/[prefix] | /bucket/[prefix] localdir)",
+		"cloudstream sync [-concurrency n] [-dry-run] [-compare size|size+mtime|checksum] [-digest-cache file] [-two-way -state file [-winner local|remote|newer]] [-delete] [-backup-dir /bucket/prefix] [-list-cache file [-list-cache-ttl duration]] [-finalize] [-on-error continue|fail|retry-later [-state file]] (localdir /bucket/[prefix] | gs|s3://bucket/[prefix] localdir)",
+		"cloudstream daemon",
+		"cloudstream serve media|www|webdav [-listen address] [-auth file] [-index name] [-notfound name] /bucket/[prefix]",
+		"cloudstream serve sftp [-listen address] -host-key file -user name=file ... [-user-dirs] /bucket/[prefix]",
+		"cloudstream mount [-rw] /bucket/[prefix] mountpoint",
+		"cloudstream buckets [-project project]",
+		"cloudstream mkbucket [-location location] [-class class] [-project project] /bucket",
+		"cloudstream rmbucket [-force [-concurrency n]] /bucket",
+		"cloudstream versioning on|off|status /bucket",
+		"cloudstream autoclass on [-terminal-class class]|off|status /bucket",
+		"cloudstream defaultkms set key|clear|status /bucket",
+		"cloudstream uniformaccess on|off|status /bucket",
+		"cloudstream public-access-prevention enforce|inherited|status /bucket",
+		"cloudstream iam get|set [-force] /bucket",
+		"cloudstream hmackey [-project project] create email | list [email] | activate id | deactivate id | delete id",
+		"cloudstream rekey encryption flags new-encryption flags path ...",
+		"cloudstream raw [-body] [-header 'name: value' ...] [-i] method path",
+		"cloudstream sign [-dry-run] method path ['name: value' ...]",
+		"cloudstream presign [-expires duration] [-method GET|PUT] [-content-type type] path",
+		"",
+		"encryption flags: -key-file file | -passphrase-file file | -passphrase-fd n | -passphrase",
+		"global flags, before the command: -profile name, -endpoint url, -limit-rate rate",
+	}
+	for i, l := range lines {
+		if i == 0 {
+			fmt.Fprintln(os.Stderr, "usage: "+l)
+		} else if l == "" || !strings.HasPrefix(l, "cloudstream ") {
+			fmt.Fprintln(os.Stderr, l)
+		} else {
+			fmt.Fprintln(os.Stderr, "       "+l)
+		}
+	}
 	os.Exit(2)
 }
 
@@ -61,10 +915,11 @@ func fail(s string) {
 	os.Exit(1)
 }
 
-// looks for config file in current directory, then directories higher up
+// looks for config file in current directory, then directories higher up,
+// returns the empty string if there is none
 func findconfig(p, name string) string {
 	var err error
-	if p != "" {
+	if p == "" {
 		p, err = os.Getwd()
 		if err != nil {
 			fail(fmt.Sprintf("finding %s: %s", name, err))
@@ -81,149 +936,609 @@ func findconfig(p, name string) string {
 		}
 		p = np
 	}
-	fail("could not find " + name)
-	panic("")
+	return ""
 }
 
-func parseconfig(p string) {
+// Parse the configuration file at p.  The lines of profile, if not empty,
+// are applied after the lines outside profiles, overriding them.
+func parseconfig(p, profile string) {
 	lines, err := tokenize.File(p)
 	if err != nil {
+		fail(fmt.Sprintf("reading %s: %s", p, err))
 	}
+	var global, selected [][]string
+	var block string // Name of the profile being read.
+	found := profile == ""
 	for _, l := range lines {
-		cmd, l := l[0], l[1:]
-		need := func(n int) {
-			if n != len(l) {
-				fail(fmt.Sprintf("bad parameters for %q, expected %d, saw %d", cmd, n, len(l)))
+		switch {
+		case l[0] == "profile":
+			if len(l) != 3 || l[2] != "{" {
+				fail(`bad profile line, expected "profile name {"`)
+			}
+			if block != "" {
+				fail(fmt.Sprintf("profile %q inside profile %q", l[1], block))
 			}
+			block = l[1]
+			found = found || block == profile
+		case block != "" && len(l) == 1 && l[0] == "}":
+			block = ""
+		case block == "":
+			global = append(global, l)
+		case block == profile:
+			selected = append(selected, l)
 		}
-		switch cmd {
-		case "accesskey":
-			need(1)
-			config.AccessKey = l[0]
-		case "secret":
-			need(1)
-			config.Secret = l[0]
-		default:
-			fail(fmt.Sprintf("bad config command %q", cmd))
+	}
+	if block != "" {
+		fail(fmt.Sprintf("profile %q not closed with }", block))
+	}
+	if !found {
+		fail(fmt.Sprintf("no profile %q in %s", profile, p))
+	}
+	// Settings of the profile replace the global ones, also those that can
+	// be repeated, like bandwidth.
+	override := map[string]bool{}
+	for _, l := range selected {
+		override[l[0]] = true
+	}
+	for _, l := range global {
+		if !override[l[0]] {
+			configline(l[0], l[1:])
 		}
 	}
+	for _, l := range selected {
+		configline(l[0], l[1:])
+	}
 }
 
-// Make HTTP authorization header for AWS-style authentication.
-func authorize(msg string) string {
-	h := hmac.New(sha1.New, []byte(config.Secret))
-	h.Write([]byte(msg))
-	sig := base64.StdEncoding.EncodeToString(h.Sum(nil))
-	return fmt.Sprintf("AWS %s:%s", config.AccessKey, sig)
+func configline(cmd string, l []string) {
+	var err error
+	need := func(n int) {
+		if n != len(l) {
+			fail(fmt.Sprintf("bad parameters for %q, expected %d, saw %d", cmd, n, len(l)))
+		}
+	}
+	switch cmd {
+	case "accesskey":
+		need(1)
+		config.AccessKey = l[0]
+	case "secret":
+		need(1)
+		config.Secret = l[0]
+	case "filters":
+		need(1)
+		config.Filters = l[0]
+	case "kmskey":
+		need(1)
+		config.KMSKey = l[0]
+	case "scrub":
+		if len(l) != 2 && len(l) != 3 {
+			fail(fmt.Sprintf("bad parameters for %q, expected path, interval and optional sample fraction", cmd))
+		}
+		// Passed through makepath by the daemon, once -endpoint is applied.
+		job := scrubjob{Path: l[0], Sample: 1}
+		job.Interval, err = time.ParseDuration(l[1])
+		if err != nil || job.Interval <= 0 {
+			fail(fmt.Sprintf("bad interval %q for scrub", l[1]))
+		}
+		if len(l) == 3 {
+			job.Sample, err = strconv.ParseFloat(l[2], 64)
+			if err != nil || job.Sample <= 0 || job.Sample > 1 {
+				fail(fmt.Sprintf("bad sample fraction %q for scrub, must be in (0,1]", l[2]))
+			}
+		}
+		config.Scrubs = append(config.Scrubs, job)
+	case "scrubreports":
+		need(1)
+		config.ScrubReports = l[0]
+	case "bandwidth":
+		if len(l) != 1 && len(l) != 2 {
+			fail(fmt.Sprintf("bad parameters for %q, expected optional time window and rate", cmd))
+		}
+		var w bandwidthwindow
+		if len(l) == 2 {
+			w, err = parsewindow(l[0])
+			if err != nil {
+				fail(err.Error())
+			}
+		}
+		if l[len(l)-1] != "unlimited" {
+			w.Rate, err = parsesize(l[len(l)-1])
+			if err != nil || w.Rate == 0 {
+				fail(fmt.Sprintf("bad rate %q for bandwidth, must be bytes per second or unlimited", l[len(l)-1]))
+			}
+		}
+		config.Bandwidth = append(config.Bandwidth, w)
+	case "signature":
+		need(1)
+		if l[0] != "v2" && l[0] != "v4" {
+			fail(fmt.Sprintf("bad signature %q, must be v2 or v4", l[0]))
+		}
+		config.Signature = l[0]
+	case "endpoint":
+		need(1)
+		config.Endpoint, err = parseendpoint(l[0])
+		if err != nil {
+			fail(err.Error())
+		}
+	case "addressing":
+		need(1)
+		if l[0] != "path" && l[0] != "virtual" {
+			fail(fmt.Sprintf("bad addressing %q, must be path or virtual", l[0]))
+		}
+		config.Addressing = l[0]
+	case "retries":
+		need(1)
+		config.Retries, err = strconv.Atoi(l[0])
+		if err != nil || config.Retries < 0 {
+			fail(fmt.Sprintf("bad retries %q", l[0]))
+		}
+	case "partsize":
+		need(1)
+		config.PartSize, err = parsesize(l[0])
+		if err != nil || config.PartSize < minpartsize {
+			fail(fmt.Sprintf("bad partsize %q, must be at least 5M", l[0]))
+		}
+	case "partconcurrency":
+		need(1)
+		config.PartConcurrency, err = strconv.Atoi(l[0])
+		if err != nil || config.PartConcurrency <= 0 {
+			fail(fmt.Sprintf("bad partconcurrency %q", l[0]))
+		}
+	case "region":
+		need(1)
+		config.Region = l[0]
+	case "project":
+		need(1)
+		config.Project = l[0]
+	case "serviceaccount":
+		need(1)
+		config.ServiceAccount = l[0]
+	case "tokencommand":
+		if len(l) == 0 {
+			fail(fmt.Sprintf("bad parameters for %q, expected command", cmd))
+		}
+		config.TokenCommand = l
+	case "scrubhook":
+		if len(l) == 0 {
+			fail(fmt.Sprintf("bad parameters for %q, expected command", cmd))
+		}
+		config.ScrubHook = l
+	default:
+		fail(fmt.Sprintf("bad config command %q", cmd))
+	}
 }
 
-func main() {
-	if len(os.Args) < 3 {
-		usage()
+var client = new(http.Client)
+
+const googleendpoint = "https://storage.googleapis.com"
+
+// Check an endpoint url, returning it without trailing slash.
+func parseendpoint(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.RawQuery != "" {
+		return "", fmt.Errorf("bad endpoint %q, must be an http or https url", s)
 	}
+	return strings.TrimSuffix(s, "/"), nil
+}
 
-	parseconfig(findconfig("", "cloudstream.conf"))
+func endpoint() string {
+	if config.Endpoint == "" {
+		return googleendpoint
+	}
+	return config.Endpoint
+}
 
-	makepath := func(path string) string {
-		if !strings.HasPrefix(path, "/") {
-			path = "/" + path
+// Whether requests go to Google Cloud Storage, and not to another
+// S3-compatible server.
+func googlestorage() bool {
+	return endpoint() == googleendpoint
+}
+
+// URL for a request for path, which starts with the bucket.  With
+// virtual-hosted addressing, the bucket is moved to the host name.
+func requesturl(path string) string {
+	if config.Addressing == "virtual" && strings.HasPrefix(path, "/") && len(path) > 1 {
+		bucket := path[1:]
+		rest := ""
+		if i := strings.IndexAny(bucket, "/?"); i >= 0 {
+			bucket, rest = bucket[:i], bucket[i:]
+		}
+		if !strings.HasPrefix(rest, "/") {
+			rest = "/" + rest
 		}
-		return path
+		scheme, host := "https", endpoint()
+		if i := strings.Index(host, "://"); i >= 0 {
+			scheme, host = host[:i], host[i+3:]
+		}
+		return scheme + "://" + bucket + "." + host + rest
 	}
+	return endpoint() + path
+}
 
-	writeresponse := func(resp *http.Response) {
-		out := os.Stdout
-		if resp.StatusCode != 200 {
-			out = os.Stderr
+// Execute a signed request for path on cloud storage.  Path is sent as
+// is, object names must be escaped with escapepath.  Path can end with a
+// query string.  Header may be nil.  If body can be read again, i.e. it
+// is nil or an io.Seeker, transient failures are retried, see retry.go.
+// And if the request is rejected because the local clock is off, it is
+// signed again with the time of the server and retried.
+func request(method, path string, header http.Header, body io.Reader) (*http.Response, error) {
+	// An explicit key, e.g. of the source of a copy, takes precedence.
+	if csekkey != nil && csekrequest(method, path) && header.Get("x-goog-encryption-key") == "" {
+		h := http.Header{}
+		for k, v := range header {
+			h[k] = v
 		}
-
-		defer resp.Body.Close()
-		_, err := io.Copy(out, resp.Body)
-		if resp.StatusCode != 200 {
-			fail("status: " + resp.Status)
+		csekheader(h, "x-goog-", csekkey)
+		header = h
+	}
+	if !googlestorage() {
+		var err error
+		header, err = s3requestheader(header)
+		if err != nil {
+			return nil, err
 		}
+	}
+	seeker, replayable := body.(io.Seeker)
+	var start int64
+	if body == nil {
+		replayable = true
+	} else if !replayable {
+		// A streamed body cannot be sent again, check the clock beforehand.
+		checkclock()
+	} else if pos, err := seeker.Seek(0, io.SeekCurrent); err != nil {
+		return nil, err
+	} else {
+		start = pos
+	}
+	clockretried := false
+	for attempt := 0; ; {
+		req, err := http.NewRequest(method, requesturl(path), body)
 		if err != nil {
-			fail(err.Error())
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if err := sign(req, path); err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err == nil && !googlestorage() {
+			s3responseheader(resp.Header)
+		}
+		if !replayable {
+			return resp, err
+		}
+		if err == nil && !clockretried && clockskewed(resp) {
+			clockretried = true
+		} else if attempt < retries() && transient(resp, err) {
+			delay := backoff(attempt, resp)
+			reason := ""
+			if err != nil {
+				reason = err.Error()
+			} else {
+				reason = resp.Status
+			}
+			fmt.Fprintf(os.Stderr, "%s %s: %s, retrying in %s\n", method, path, reason, delay.Round(time.Second))
+			time.Sleep(delay)
+			attempt++
+		} else {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if seeker != nil {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
 		}
 	}
+}
 
-	cmd := os.Args[1]
-	args := os.Args[2:]
-	switch cmd {
-	default:
-		usage()
+// Error for an unexpected response status.
+type httperror = objects.StatusError
 
-	case "get":
-		if len(args) != 1 {
-			usage()
+// Error for an unexpected response, with the start of its body for details.
+func statuserror(resp *http.Response) error {
+	return objects.ResponseError(resp)
+}
+
+// Whether err is an httperror with status code.
+func iserrorstatus(err error, code int) bool {
+	var he *httperror
+	return errors.As(err, &he) && he.Code == code
+}
+
+// Fetch the headers of the object at path with a HEAD request.
+func head(path string) (http.Header, error) {
+	return headwith(path, nil)
+}
+
+// Like head, with request headers, e.g. an encryption key.
+func headwith(path string, header http.Header) (http.Header, error) {
+	resp, err := request("HEAD", escapepath(path), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &httperror{Code: resp.StatusCode, Msg: fmt.Sprintf("status: %s", resp.Status)}
+	}
+	return resp.Header, nil
+}
+
+// Whether path is a gs:// or s3:// URI, a remote path that can't be
+// mistaken for a local one.
+func isuri(path string) bool {
+	return strings.HasPrefix(path, "gs://") || strings.HasPrefix(path, "s3://")
+}
+
+// Path "/bucket/name" from a command-line argument.  Besides
+// "/bucket/name" and "bucket/name", the URI forms of gsutil and the aws
+// cli are accepted: "gs://bucket/name" and "s3://bucket/name".  Without
+// configured endpoint, an s3:// path selects AWS S3.
+func makepath(path string) string {
+	switch {
+	case strings.HasPrefix(path, "gs://"):
+		if !googlestorage() {
+			fail(fmt.Sprintf("%s: gs:// path, but endpoint is %s", path, endpoint()))
 		}
-		path := makepath(args[0])
-		client := new(http.Client)
-		req, err := http.NewRequest("GET", "https://storage.googleapis.com"+path, nil)
-		if err != nil {
-			fail(err.Error())
+		path = strings.TrimPrefix(path, "gs:/")
+	case strings.HasPrefix(path, "s3://"):
+		if config.Endpoint == "" {
+			// No endpoint configured, the scheme selects AWS.
+			config.Endpoint = "https://s3.amazonaws.com"
+			if config.Region != "" {
+				config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+			}
+		} else if googlestorage() {
+			fail(fmt.Sprintf("%s: s3:// path, but endpoint is %s", path, endpoint()))
 		}
+		path = strings.TrimPrefix(path, "s3:/")
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
 
-		date := time.Now().Format(time.RFC1123Z)
-		req.Header.Add("Date", date)
+// Percent-encode path for use in a request url, see objects.EscapePath.
+func escapepath(path string) string {
+	return objects.EscapePath(path)
+}
 
-		msg := "GET\n"
-		msg += "\n"
-		msg += "\n"
-		msg += date + "\n"
-		msg += path
+// Split path into bucket and object name.
+func splitpath(path string) (bucket, name string) {
+	t := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(t) == 1 {
+		return t[0], ""
+	}
+	return t[0], t[1]
+}
 
-		req.Header.Add("Authorization", authorize(msg))
+// Set by put -tee, stdout has the uploaded data.
+var discardresponse bool
 
-		resp, err := client.Do(req)
-		if err != nil {
-			fail(err.Error())
-		}
-		writeresponse(resp)
+// Copy the body of a successful response to stdout, or the error
+// response to stderr and fail.
+func writeresponse(resp *http.Response) {
+	var out io.Writer = os.Stdout
+	ok := resp.StatusCode == 200 || resp.StatusCode == 206
+	if !ok {
+		out = os.Stderr
+	} else if discardresponse {
+		out = io.Discard
+	}
 
-	case "put":
-		if len(args) != 1 {
-			usage()
-		}
+	defer resp.Body.Close()
+	_, err := io.Copy(out, resp.Body)
+	if !ok {
+		fail("status: " + resp.Status)
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+}
 
-		path := makepath(args[0])
+// Fail with err, with exit status 4 if a precondition failed, e.g. the
+// file exists with -if-not-exists.  Scripts can tell another job got
+// there first from other errors.
+func failerror(err error) {
+	if iserrorstatus(err, 412) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(4)
+	}
+	fail(err.Error())
+}
 
-		client := new(http.Client)
-		req, err := http.NewRequest("PUT", "https://storage.googleapis.com"+path, nil)
-		if err != nil {
-			fail(err.Error())
+// Exit after a transfer was stopped by -max-duration, printing how to continue.
+func checkpoint(cmd string) {
+	fmt.Fprintln(os.Stderr, "maximum duration reached, continue with:")
+	fmt.Fprintln(os.Stderr, "\t"+cmd)
+	os.Exit(3)
+}
+
+// Parse flags for a subcommand.  Unlike fs.Parse, flags may come after
+// the non-flag arguments, e.g. "put /bucket/file -if-not-exists".
+func parseflags(fs *flag.FlagSet, args []string) []string {
+	var r []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return r
 		}
+		r = append(r, args[0])
+		args = args[1:]
+	}
+}
 
-		date := time.Now().Format(time.RFC1123Z)
-		req.Header.Add("Date", date)
+// Size in bytes, as flag.  Accepts an optional suffix k, M, G or T, in
+// powers of 1024.  A negative value means "not set".
+type size int64
 
-		msg := "PUT\n"
-		msg += "\n"
-		msg += "\n"
-		msg += date + "\n"
-		msg += path
+func (s *size) String() string {
+	return fmt.Sprintf("%d", *s)
+}
 
-		req.Header.Add("Authorization", authorize(msg))
+func (s *size) Set(v string) error {
+	n, err := parsesize(v)
+	if err != nil {
+		return err
+	}
+	*s = size(n)
+	return nil
+}
 
-		req.ContentLength = 0
-		pr, pw := io.Pipe()
-		req.Body = pr
-		go func() {
-			_, err := io.Copy(pw, os.Stdin)
-			if err != nil {
-				pw.CloseWithError(err)
-				return
-			}
-			err = pw.Close()
-			if err != nil {
-				fail(err.Error())
-			}
-		}()
+func parsesize(s string) (int64, error) {
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		case 't', 'T':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * mult, nil
+}
 
-		resp, err := client.Do(req)
+func main() {
+	args := os.Args[1:]
+	profile := os.Getenv("CLOUDSTREAM_PROFILE")
+	var endpointflag, limitrate string
+	for len(args) >= 2 {
+		if args[0] == "-profile" || args[0] == "--profile" {
+			profile = args[1]
+		} else if args[0] == "-endpoint" || args[0] == "--endpoint" {
+			endpointflag = args[1]
+		} else if args[0] == "-limit-rate" || args[0] == "--limit-rate" {
+			limitrate = args[1]
+		} else {
+			break
+		}
+		args = args[2:]
+	}
+	if len(args) < 1 {
+		usage()
+	}
+
+	config.Retries = -1
+	// Without configuration file, application default credentials are used.
+	if p := findconfig("", "cloudstream.conf"); p != "" {
+		parseconfig(p, profile)
+	} else if profile != "" {
+		fail("no cloudstream.conf for profile " + profile)
+	}
+	if endpointflag != "" {
+		var err error
+		config.Endpoint, err = parseendpoint(endpointflag)
 		if err != nil {
 			fail(err.Error())
 		}
-		writeresponse(resp)
+	}
+	if limitrate != "" {
+		// Replaces the windows of the configuration file.
+		var w bandwidthwindow
+		if limitrate != "unlimited" {
+			var err error
+			w.Rate, err = parsesize(limitrate)
+			if err != nil || w.Rate == 0 {
+				fail(fmt.Sprintf("bad -limit-rate %q, must be bytes per second or unlimited", limitrate))
+			}
+		}
+		config.Bandwidth = []bandwidthwindow{w}
+	}
+	if len(config.Bandwidth) > 0 {
+		client.Transport = limitedtransport()
+	}
+
+	cmd := args[0]
+	args = args[1:]
+	switch cmd {
+	default:
+		usage()
+	case "get":
+		get(args)
+	case "put":
+		put(args)
+	case "put-tar":
+		puttar(args)
+	case "get-tar":
+		gettar(args)
+	case "cp":
+		cp(args)
+	case "batch":
+		batch(args)
+	case "compose":
+		composecmd(args)
+	case "mv":
+		mv(args)
+	case "rm":
+		rm(args)
+	case "setmeta":
+		setmeta(args)
+	case "rewrite":
+		rewrite(args)
+	case "stat", "head":
+		stat(args)
+	case "hold":
+		hold(args)
+	case "ls", "list":
+		ls(args)
+	case "du":
+		du(args)
+	case "find":
+		find(args)
+	case "buckets":
+		buckets(args)
+	case "mkbucket":
+		mkbucket(args)
+	case "rmbucket":
+		rmbucket(args)
+	case "versioning":
+		versioning(args)
+	case "autoclass":
+		autoclass(args)
+	case "defaultkms":
+		defaultkms(args)
+	case "uniformaccess":
+		uniformaccess(args)
+	case "public-access-prevention":
+		publicaccessprevention(args)
+	case "iam":
+		iam(args)
+	case "hmackey":
+		hmackey(args)
+	case "rekey":
+		rekey(args)
+	case "raw":
+		raw(args)
+	case "sign":
+		signcmd(args)
+	case "presign":
+		presign(args)
+	case "verify":
+		verify(args)
+	case "sync":
+		syncdir(args)
+	case "daemon":
+		daemon(args)
+	case "serve":
+		serve(args)
+	case "mount":
+		mount(args)
 	}
 }
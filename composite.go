@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Parallel composite uploads: the data is uploaded as temporary
+// component files, concurrently, which are then composed into the
+// destination.  A compose request takes at most 32 components, longer
+// streams are composed in steps, each step adding to the result of the
+// previous.  The temporary files are removed afterwards.  Composite
+// files have a crc32c, but no md5.
+
+const maxcomponents = 32
+
+// Compose existing files into a new file, e.g. parts uploaded
+// separately.  More than maxcomponents files are composed in steps,
+// through temporary files.
+func composecmd(args []string) {
+	fs := flag.NewFlagSet("compose", flag.ExitOnError)
+	fs.Usage = usage
+	contenttype := fs.String("content-type", "", "content-type of the destination, default by extension")
+	ifnotexists := fs.Bool("if-not-exists", false, "only create the destination, fail if it already exists")
+	remove := fs.Bool("rm", false, "remove the source files after composing")
+	key, _ := csekflags(fs, false)
+	args = parseflags(fs, args)
+	if len(args) < 2 {
+		usage()
+	}
+	if !googlestorage() {
+		fail("compose needs google cloud storage")
+	}
+	setcsek(*key)
+	var paths []string
+	for _, a := range args {
+		paths = append(paths, makepath(a))
+	}
+	dst, srcs := paths[len(paths)-1], paths[:len(paths)-1]
+	bucket, name := splitpath(dst)
+	if name == "" {
+		fail("destination must be a file")
+	}
+	for _, p := range srcs {
+		if b, n := splitpath(p); b != bucket || n == "" {
+			fail(p + ": source must be a file in the bucket of the destination")
+		}
+	}
+
+	header := http.Header{}
+	if *contenttype != "" {
+		header.Set("Content-Type", *contenttype)
+	} else if t := extensiontype(dst); t != "" {
+		header.Set("Content-Type", t)
+	}
+	if *ifnotexists {
+		header.Set("x-goog-if-generation-match", "0")
+	}
+
+	rnd := make([]byte, 8)
+	if _, err := rand.Read(rnd); err != nil {
+		fail(err.Error())
+	}
+	var temporary []string
+	resp, err := composesteps(dst, srcs, header, fmt.Sprintf("%s.cloudstream-compose-%x-", dst, rnd), &temporary)
+	for _, p := range temporary {
+		if err := deleteobject(p, nil); err != nil && !iserrorstatus(err, 404) {
+			fmt.Fprintf(os.Stderr, "removing temporary file %s: %s\n", p, err)
+		}
+	}
+	if err != nil {
+		failerror(err)
+	}
+	resp.Body.Close()
+	if *remove {
+		for _, p := range srcs {
+			// The destination can be one of the sources, adding to it.
+			if p == dst {
+				continue
+			}
+			if err := deleteobject(p, nil); err != nil && !iserrorstatus(err, 404) {
+				failerror(fmt.Errorf("%s: %s", p, err))
+			}
+		}
+	}
+}
+
+type composerequest struct {
+	XMLName    xml.Name           `xml:"ComposeRequest"`
+	Components []composecomponent `xml:"Component"`
+}
+
+type composecomponent struct {
+	Name string
+}
+
+// Upload src to path as a composite file.  Header holds the headers for
+// the destination.  Data smaller than a part is uploaded with a single
+// request.
+func compositeput(path string, header http.Header, src io.Reader, partsize int64, concurrency int) (*http.Response, error) {
+	first := make([]byte, partsize)
+	n, err := io.ReadFull(src, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		h := http.Header{}
+		for k, v := range header {
+			h[k] = v
+		}
+		h.Set("x-goog-hash", datahash(first[:n]).header())
+		return putobject(path, h, bytes.NewReader(first[:n]))
+	} else if err != nil {
+		return nil, err
+	}
+
+	rnd := make([]byte, 8)
+	if _, err := rand.Read(rnd); err != nil {
+		return nil, err
+	}
+	tmp := fmt.Sprintf("%s.cloudstream-part-%x-", path, rnd)
+	var mutex sync.Mutex
+	var temporary []string
+	defer func() {
+		for _, p := range temporary {
+			if err := deleteobject(p, nil); err != nil && !iserrorstatus(err, 404) {
+				fmt.Fprintf(os.Stderr, "removing temporary file %s: %s\n", p, err)
+			}
+		}
+	}()
+
+	var nparts int
+	err = uploadparts(src, first, partsize, concurrency, func(number int, buf []byte) error {
+		p := fmt.Sprintf("%s%d", tmp, number)
+		mutex.Lock()
+		temporary = append(temporary, p)
+		if number > nparts {
+			nparts = number
+		}
+		mutex.Unlock()
+		header := http.Header{"x-goog-hash": {datahash(buf).header()}}
+		resp, err := request("PUT", escapepath(p), header, bytes.NewReader(buf))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return statuserror(resp)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var components []string
+	for i := 1; i <= nparts; i++ {
+		components = append(components, fmt.Sprintf("%s%d", tmp, i))
+	}
+	// Composite files have no md5, a hash of the whole data, e.g. of a file
+	// as stdin, can't be sent with the compose.  Its crc32c is compared with
+	// that of the result instead.
+	expected := parsegooghash(header)
+	h := http.Header{}
+	for k, v := range header {
+		h[k] = v
+	}
+	h.Del("x-goog-hash")
+	resp, err := composesteps(path, components, h, tmp, &temporary)
+	if err != nil {
+		return nil, err
+	}
+	expected.md5 = ""
+	if msg := expected.mismatch(parsegooghash(resp.Header)); msg != "" {
+		resp.Body.Close()
+		var dh http.Header
+		if g := resp.Header.Get("x-goog-generation"); g != "" {
+			dh = http.Header{"x-goog-if-generation-match": {g}}
+		}
+		if err := deleteobject(path, dh); err != nil {
+			return nil, fmt.Errorf("composed file: %s, removing: %s", msg, err)
+		}
+		return nil, fmt.Errorf("composed file: %s, removed", msg)
+	}
+	return resp, nil
+}
+
+// Compose components into dst, in steps of at most maxcomponents, with
+// the intermediate results in files named tmp+"compose-"+step, each step
+// adding to the result of the previous.  Names of intermediate files are
+// added to temporary, for removal by the caller.
+func composesteps(dst string, components []string, header http.Header, tmp string, temporary *[]string) (*http.Response, error) {
+	var prev string // Result of the previous compose step.
+	for step := 1; ; step++ {
+		var l []string
+		if prev != "" {
+			l = append(l, prev)
+		}
+		k := maxcomponents - len(l)
+		if k > len(components) {
+			k = len(components)
+		}
+		l = append(l, components[:k]...)
+		components = components[k:]
+		if len(components) == 0 {
+			return compose(dst, l, header)
+		}
+		prev = fmt.Sprintf("%scompose-%d", tmp, step)
+		*temporary = append(*temporary, prev)
+		resp, err := compose(prev, l, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+	}
+}
+
+// Compose the files at paths, in the same bucket as dst, into dst.
+// Header holds the headers for dst.
+func compose(dst string, paths []string, header http.Header) (*http.Response, error) {
+	var cr composerequest
+	for _, p := range paths {
+		_, name := splitpath(p)
+		cr.Components = append(cr.Components, composecomponent{name})
+	}
+	buf, err := xml.Marshal(cr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := request("PUT", escapepath(dst)+"?compose", header, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		return nil, statuserror(resp)
+	}
+	return resp, nil
+}
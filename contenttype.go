@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+)
+
+// Content type of new files, when not set explicitly: by the extension of
+// the name, or else by the first 512 bytes of the data, see
+// http.DetectContentType.  Without, cloud storage stores files as
+// application/octet-stream.
+
+// Content type by the extension of name, empty if unknown.
+func extensiontype(name string) string {
+	return mime.TypeByExtension(path.Ext(name))
+}
+
+// Detect the type of the data of r for name.  The returned reader
+// returns all data of r.
+func detectcontenttype(name string, r io.Reader) (string, io.Reader, error) {
+	if t := extensiontype(name); t != "" {
+		return t, r, nil
+	}
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	return http.DetectContentType(buf[:n]), io.MultiReader(bytes.NewReader(buf[:n]), r), nil
+}
+
+// Detect the type of the data of f, from its current offset, for name.
+// The offset of f is not changed.
+func filecontenttype(name string, f *os.File) (string, error) {
+	if t := extensiontype(name); t != "" {
+		return t, nil
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 512)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"bitbucket.org/mjl/cloudstream/objects"
+)
+
+func cp(args []string) {
+	fs := flag.NewFlagSet("cp", flag.ExitOnError)
+	fs.Usage = usage
+	preserve := fs.Bool("preserve", false, "carry over content-type, cache-control, custom metadata and storage class")
+	preserveacl := fs.Bool("preserve-acl", false, "copy the acl too")
+	ifnotexists := fs.Bool("if-not-exists", false, "only create the destination, fail if it already exists")
+	key, sourcekey := csekflags(fs, true)
+	args = parseflags(fs, args)
+	if len(args) != 2 {
+		usage()
+	}
+	setcsek(*key)
+	header := http.Header{}
+	if *ifnotexists {
+		header.Set("x-goog-if-generation-match", "0")
+	}
+	// With only -csek-key, the source has the same key.  With only
+	// -source-csek-key, the copy is not encrypted with a key of our own.
+	if *sourcekey != "" || csekkey != nil {
+		k := csekkey
+		if *sourcekey != "" {
+			var err error
+			k, err = parsecsek(*sourcekey)
+			if err != nil {
+				fail(err.Error())
+			}
+		}
+		csekheader(header, "x-goog-copy-source-", k)
+	}
+	if err := copyobject(makepath(args[0]), makepath(args[1]), header, *preserve, *preserveacl); err != nil {
+		failerror(err)
+	}
+}
+
+// Copy object src to dst within cloud storage.  The destination gets
+// fresh metadata, apart from cloudstream's own.  With preserve, the
+// metadata of src is carried over, with preserveacl its acl too.  Header
+// can hold preconditions, for src and dst.
+func copyobject(src, dst string, header http.Header, preserve, preserveacl bool) error {
+	var sh http.Header
+	if k := header.Get("x-goog-copy-source-encryption-key"); k != "" {
+		sh = http.Header{}
+		for _, s := range []string{"algorithm", "key", "key-sha256"} {
+			sh.Set("x-goog-encryption-"+s, header.Get("x-goog-copy-source-encryption-"+s))
+		}
+	}
+	oh, err := headwith(src, sh)
+	if err != nil {
+		return fmt.Errorf("%s: %s", src, err)
+	}
+	h := http.Header{}
+	if preserve {
+		h = objects.ObjectHeaders(oh)
+	} else {
+		for k, v := range oh {
+			if strings.HasPrefix(strings.ToLower(k), "x-goog-meta-cloudstream-") {
+				h[k] = v
+			}
+		}
+	}
+	for k, v := range header {
+		h[k] = v
+	}
+	h.Set("x-goog-copy-source", escapepath(src))
+	h.Set("x-goog-metadata-directive", "REPLACE")
+	resp, err := request("PUT", escapepath(dst), h, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("copying to %s: %w", dst, statuserror(resp))
+	}
+
+	if preserveacl {
+		resp, err := request("GET", escapepath(src)+"?acl", nil, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			bucket, _ := splitpath(src)
+			return fmt.Errorf("fetching acl of %s: %s", src, aclerror(bucket, resp))
+		}
+		acl, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if err := setacl(dst, acl); err != nil {
+			return fmt.Errorf("setting acl of %s: %s", dst, err)
+		}
+	}
+	return nil
+}
+
+// Set the acl of object path to the AccessControlList xml document.
+func setacl(path string, acl []byte) error {
+	resp, err := request("PUT", escapepath(path)+"?acl", nil, bytes.NewReader(acl))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		bucket, _ := splitpath(path)
+		return aclerror(bucket, resp)
+	}
+	return nil
+}
+
+// Move src to dst: copy, check the copy, and remove src.
+func mv(args []string) {
+	fs := flag.NewFlagSet("mv", flag.ExitOnError)
+	fs.Usage = usage
+	preserveacl := fs.Bool("preserve-acl", false, "copy the acl too")
+	ifnotexists := fs.Bool("if-not-exists", false, "only create the destination, fail if it already exists")
+	args = parseflags(fs, args)
+	if len(args) != 2 {
+		usage()
+	}
+	src, dst := makepath(args[0]), makepath(args[1])
+
+	sh, err := head(src)
+	if err != nil {
+		fail(fmt.Sprintf("%s: %s", src, err))
+	}
+	generation := sh.Get("x-goog-generation")
+	// Copy the version that was checked, and remove only that version.
+	header := http.Header{"X-Goog-Copy-Source-If-Generation-Match": {generation}}
+	if *ifnotexists {
+		header.Set("x-goog-if-generation-match", "0")
+	}
+	if err := copyobject(src, dst, header, true, *preserveacl); err != nil {
+		fail(err.Error())
+	}
+
+	dh, err := head(dst)
+	if err != nil {
+		fail(fmt.Sprintf("checking copy %s: %s, not removing %s", dst, err, src))
+	}
+	if s, d := sh.Get("Content-Length"), dh.Get("Content-Length"); s != d {
+		fail(fmt.Sprintf("copy %s has size %s, expected %s, not removing %s", dst, d, s, src))
+	}
+	sg, dg := parsegooghash(sh), parsegooghash(dh)
+	if sg.crc32c == "" || dg.crc32c == "" {
+		fail(fmt.Sprintf("missing crc32c hash for checking copy %s, not removing %s", dst, src))
+	}
+	if s := sg.mismatch(dg); s != "" {
+		fail(fmt.Sprintf("copy %s: %s, not removing %s", dst, s, src))
+	}
+
+	if err := deleteobject(src, http.Header{"X-Goog-If-Generation-Match": {generation}}); err != nil {
+		fail(fmt.Sprintf("removing %s: %s", src, err))
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// Application default credentials, used when no HMAC key, service
+// account or token command is configured.  They are looked for in order:
+// the JSON file named by $GOOGLE_APPLICATION_CREDENTIALS, the file
+// written by "gcloud auth application-default login", and the metadata
+// server of GCE and GKE.
+
+// Fetch an access token with application default credentials.
+func defaulttoken() (string, time.Time, error) {
+	if p := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); p != "" {
+		return credentialsfiletoken(p)
+	}
+	if p := gcloudcredentials(); p != "" {
+		if _, err := os.Stat(p); err == nil {
+			return credentialsfiletoken(p)
+		}
+	}
+	tok, expires, err := metadatatoken()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("no credentials, configure an accesskey and secret, a serviceaccount or tokencommand, or set up application default credentials (metadata server: %s)", err)
+	}
+	return tok, expires, nil
+}
+
+// Path of the application default credentials written by gcloud.
+func gcloudcredentials() string {
+	dir := os.Getenv("CLOUDSDK_CONFIG")
+	if dir == "" && runtime.GOOS == "windows" {
+		dir = filepath.Join(os.Getenv("APPDATA"), "gcloud")
+	} else if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config", "gcloud")
+	}
+	return filepath.Join(dir, "application_default_credentials.json")
+}
+
+// Fetch an access token with the credentials in JSON file p, a service
+// account key, or the refresh token of a user.
+func credentialsfiletoken(p string) (string, time.Time, error) {
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var c struct {
+		Type         string `json:"type"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return "", time.Time{}, fmt.Errorf("parsing credentials %s: %s", p, err)
+	}
+	switch c.Type {
+	case "service_account":
+		k, err := readserviceaccount(p)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return k.token()
+	case "authorized_user":
+		return fetchtoken("https://oauth2.googleapis.com/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {c.ClientID},
+			"client_secret": {c.ClientSecret},
+			"refresh_token": {c.RefreshToken},
+		})
+	}
+	return "", time.Time{}, fmt.Errorf("%s: unsupported credentials type %q", p, c.Type)
+}
+
+// Fetch an access token for the default service account of the instance
+// from the metadata server.  Outside GCE, the name does not resolve or
+// the request times out quickly.
+func metadatatoken() (string, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, statuserror(resp)
+	}
+	var r struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", time.Time{}, fmt.Errorf("parsing token from metadata server: %s", err)
+	}
+	if r.AccessToken == "" {
+		return "", time.Time{}, errors.New("no access token from metadata server")
+	}
+	return r.AccessToken, time.Now().Add(time.Duration(r.ExpiresIn) * time.Second), nil
+}
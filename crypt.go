@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Client-side encryption.  Data is encrypted with a random data key,
+// unique to the object.  The data key is wrapped with a master key, and
+// stored in the object metadata, see key.go.
+//
+// The encrypted stream starts with a header:
+//
+//	magic "CSE"
+//	version byte, 1
+//	cipher byte, 1 for AES-256-GCM, 2 for XChaCha20-Poly1305
+//	random nonce prefix, nonce size of the cipher minus 5 bytes
+//
+// Then frames follow, each:
+//
+//	4-byte big-endian length of the sealed chunk, highest bit set for the final frame
+//	sealed chunk of at most framesize bytes of plaintext
+//
+// The nonce for a frame is the nonce prefix, the 4-byte big-endian
+// frame number, and a byte 1 for the final frame, 0 otherwise.  The
+// header is the additional data for each frame.  Since the final frame
+// is authenticated as such, truncation is detected, as are reordered
+// and dropped frames.  The final frame can be empty, data after it is
+// an error.
+
+// Metadata header holding the wrapped data key.
+const encryptionheader = "x-goog-meta-cloudstream-encryption"
+
+const (
+	framesize = 64 * 1024
+	finalflag = 1 << 31
+)
+
+// Ciphers for the encrypted stream, by name and header byte.
+var ciphers = map[string]byte{
+	"aes-256-gcm":        1,
+	"xchacha20-poly1305": 2,
+}
+
+var encmagic = []byte("CSE\x01")
+
+func newaead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Make the AEAD for cipher byte id of an encryption header.
+func newstreamaead(id byte, key []byte) (cipher.AEAD, error) {
+	switch id {
+	case 1:
+		return newaead(key)
+	case 2:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, fmt.Errorf("unknown cipher %d in encryption header", id)
+}
+
+func framenonce(prefix []byte, frame uint32, final bool) []byte {
+	nonce := make([]byte, len(prefix)+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], frame)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// Reader returning the encrypted stream of the data from r.
+type encryptreader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	frame  uint32
+	plain  []byte
+	obuf   []byte // Buffer for a sealed frame.
+	out    []byte // Pending encrypted data.
+	done   bool   // Whether final frame has been sealed.
+}
+
+// Cipher is a name from ciphers.
+func newencryptreader(r io.Reader, key []byte, ciphername string) (io.Reader, error) {
+	id, ok := ciphers[ciphername]
+	if !ok {
+		return nil, fmt.Errorf("unknown cipher %q", ciphername)
+	}
+	aead, err := newstreamaead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, aead.NonceSize()-5)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header := append(append(append([]byte{}, encmagic...), id), prefix...)
+	er := &encryptreader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		plain:  make([]byte, framesize),
+		obuf:   make([]byte, 0, 4+framesize+aead.Overhead()),
+		out:    header,
+	}
+	return er, nil
+}
+
+func (er *encryptreader) Read(buf []byte) (int, error) {
+	for len(er.out) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(er.r, er.plain)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return 0, err
+		}
+		prefix := er.header[len(encmagic)+1:]
+		length := uint32(n + er.aead.Overhead())
+		if final {
+			length |= finalflag
+		}
+		out := binary.BigEndian.AppendUint32(er.obuf[:0], length)
+		er.out = er.aead.Seal(out, framenonce(prefix, er.frame, final), er.plain[:n], er.header)
+		er.frame++
+		er.done = final
+	}
+	n := copy(buf, er.out)
+	er.out = er.out[n:]
+	return n, nil
+}
+
+// Reader returning the decrypted data of the encrypted stream in r.  The
+// cipher is read from the header.
+type decryptreader struct {
+	r      io.Reader
+	key    []byte
+	aead   cipher.AEAD
+	header []byte
+	frame  uint32
+	sealed []byte
+	plain  []byte
+	out    []byte // Pending decrypted data.
+	done   bool   // Whether final frame has been opened.
+}
+
+func newdecryptreader(r io.Reader, key []byte) io.Reader {
+	return &decryptreader{r: r, key: key}
+}
+
+func (dr *decryptreader) readheader() error {
+	header := make([]byte, len(encmagic)+1)
+	if _, err := io.ReadFull(dr.r, header); err != nil {
+		return fmt.Errorf("reading encryption header: %v", err)
+	}
+	if !bytes.Equal(header[:len(encmagic)], encmagic) {
+		return errors.New("unrecognized encryption header")
+	}
+	aead, err := newstreamaead(header[len(encmagic)], dr.key)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, aead.NonceSize()-5)
+	if _, err := io.ReadFull(dr.r, prefix); err != nil {
+		return fmt.Errorf("reading encryption header: %v", err)
+	}
+	dr.aead = aead
+	dr.header = append(header, prefix...)
+	dr.sealed = make([]byte, framesize+aead.Overhead())
+	dr.plain = make([]byte, 0, framesize)
+	return nil
+}
+
+func (dr *decryptreader) Read(buf []byte) (int, error) {
+	for len(dr.out) == 0 {
+		if dr.header == nil {
+			if err := dr.readheader(); err != nil {
+				return 0, err
+			}
+		}
+
+		var lenbuf [4]byte
+		_, err := io.ReadFull(dr.r, lenbuf[:])
+		if dr.done {
+			if err == io.EOF {
+				return 0, io.EOF
+			}
+			return 0, errors.New("data after final encrypted frame")
+		}
+		if err == io.EOF {
+			return 0, errors.New("encrypted stream is truncated")
+		} else if err != nil {
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(lenbuf[:])
+		final := length&finalflag != 0
+		length &^= finalflag
+		if length < uint32(dr.aead.Overhead()) || length > uint32(len(dr.sealed)) {
+			return 0, errors.New("bad encrypted frame length")
+		}
+		if _, err := io.ReadFull(dr.r, dr.sealed[:length]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, errors.New("encrypted stream is truncated")
+		} else if err != nil {
+			return 0, err
+		}
+		prefix := dr.header[len(encmagic)+1:]
+		dr.out, err = dr.aead.Open(dr.plain[:0], framenonce(prefix, dr.frame, final), dr.sealed[:length], dr.header)
+		if err != nil {
+			return 0, fmt.Errorf("decrypting frame %d: data corrupted or wrong key", dr.frame)
+		}
+		dr.frame++
+		dr.done = final
+	}
+	n := copy(buf, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
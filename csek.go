@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Customer-supplied encryption keys, see
+// https://cloud.google.com/storage/docs/encryption/customer-supplied-keys.
+// Cloud storage encrypts the data with the key, and only keeps a hash of
+// it, to reject requests with the wrong key.  Reading the data needs the
+// key again, as do writes of the object, e.g. for composing.  With the
+// key set, it is sent along with requests for objects, see request.
+
+// Key for objects, nil if not used.
+var csekkey []byte
+
+// Register flag -csek-key, and optionally -source-csek-key, returning
+// the values, to be passed to setcsek after parsing.
+func csekflags(fs *flag.FlagSet, source bool) (key, sourcekey *string) {
+	key = fs.String("csek-key", "", "base64-encoded 256-bit customer-supplied encryption key for the file")
+	if source {
+		sourcekey = fs.String("source-csek-key", "", "customer-supplied encryption key of the source, if different")
+	}
+	return
+}
+
+// Parse the key of -csek-key and set it for requests.
+func setcsek(s string) {
+	if s == "" {
+		return
+	}
+	if !googlestorage() {
+		fail("-csek-key needs google cloud storage")
+	}
+	key, err := parsecsek(s)
+	if err != nil {
+		fail(err.Error())
+	}
+	csekkey = key
+}
+
+func parsecsek(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("customer-supplied encryption key must be 32 bytes, base64-encoded")
+	}
+	return key, nil
+}
+
+// Set the headers for key on h.  Prefix is "x-goog-" for the object of
+// the request, or "x-goog-copy-source-" for the source of a copy.
+func csekheader(h http.Header, prefix string, key []byte) {
+	sum := sha256.Sum256(key)
+	h.Set(prefix+"encryption-algorithm", "AES256")
+	h.Set(prefix+"encryption-key", base64.StdEncoding.EncodeToString(key))
+	h.Set(prefix+"encryption-key-sha256", base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// Whether a request for path needs the encryption key: an object, without
+// subresource like ?acl, except compose, optionally of a generation.
+func csekrequest(method, path string) bool {
+	if method == "DELETE" {
+		return false
+	}
+	query := ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	_, name := splitpath(path)
+	return name != "" && (query == "" || query == "compose" || strings.HasPrefix(query, "generation="))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Periodic verification of the files under a prefix.
+type scrubjob struct {
+	Path     string
+	Interval time.Duration
+	Sample   float64 // Fraction of files to verify in each run, 1 for all.
+}
+
+// Written to the bucket after each scrub.
+type scrubreport struct {
+	Path     string
+	Start    time.Time
+	End      time.Time
+	Sample   float64
+	Counts   map[string]int // By verify status.
+	Problems []verifyresult // Files that did not verify.
+}
+
+func daemon(args []string) {
+	if len(args) != 0 {
+		usage()
+	}
+	if len(config.Scrubs) == 0 {
+		fail("no jobs in configuration file")
+	}
+	// Paths of the configuration file, with the endpoint of the profile
+	// and -endpoint applied.
+	for i := range config.Scrubs {
+		config.Scrubs[i].Path = makepath(config.Scrubs[i].Path)
+	}
+	if config.ScrubReports != "" {
+		config.ScrubReports = makepath(config.ScrubReports)
+	}
+
+	next := make([]time.Time, len(config.Scrubs))
+	now := time.Now()
+	for i := range next {
+		next[i] = now
+	}
+	for {
+		first := 0
+		for i := range next {
+			if next[i].Before(next[first]) {
+				first = i
+			}
+		}
+		time.Sleep(time.Until(next[first]))
+
+		job := config.Scrubs[first]
+		next[first] = time.Now().Add(job.Interval)
+		if err := scrub(job); err != nil {
+			log.Printf("scrub %s: %s", job.Path, err)
+		}
+	}
+}
+
+// Verify files under the job's prefix, write a report and call the hook
+// on problems.
+func scrub(job scrubjob) error {
+	bucket, prefix := splitpath(job.Path)
+	report := scrubreport{
+		Path:   job.Path,
+		Start:  time.Now(),
+		Sample: job.Sample,
+		Counts: map[string]int{},
+	}
+	err := listobjects(bucket, prefix, "", "", func(l []objectinfo, marker string) error {
+		for _, o := range l {
+			if job.Sample < 1 && rand.Float64() >= job.Sample {
+				continue
+			}
+			r := verifyremote(o.Name)
+			report.Counts[r.Status]++
+			if r.Status != "ok" && r.Status != "nohash" {
+				report.Problems = append(report.Problems, r)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	report.End = time.Now()
+
+	buf, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	reports := config.ScrubReports
+	if reports == "" {
+		reports = "/" + bucket + "/.cloudstream/scrub/"
+	}
+	if !strings.HasSuffix(reports, "/") {
+		reports += "/"
+	}
+	p := reports + strings.Replace(strings.Trim(job.Path, "/"), "/", "_", -1) + "-" + report.Start.UTC().Format("20060102T150405Z") + ".json"
+	header := http.Header{"Content-Type": {"application/json"}}
+	resp, err := request("PUT", escapepath(p), header, bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("writing report: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("writing report: %s", statuserror(resp))
+	}
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("scrub %s: %d files verified, %d problems, report %s", job.Path, report.Counts["ok"], len(report.Problems), p)
+
+	if len(report.Problems) > 0 && len(config.ScrubHook) > 0 {
+		cmd := exec.Command(config.ScrubHook[0], append(config.ScrubHook[1:], p)...)
+		cmd.Stdin = bytes.NewReader(buf)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("scrub hook: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
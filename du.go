@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Totals of files under a prefix, stored in the checkpoint of du.
+type dutotal struct {
+	Files int64
+	Bytes int64
+}
+
+type dustate struct {
+	Total dutotal
+	Dirs  map[string]*dutotal // By name of the directory directly under the prefix, with trailing slash.
+}
+
+// Print the number of files and bytes under a prefix, for finding what
+// takes up storage.
+func du(args []string) {
+	fs := flag.NewFlagSet("du", flag.ExitOnError)
+	fs.Usage = usage
+	dirs := fs.Bool("d", false, "also print totals for each directory directly under the prefix")
+	human := fs.Bool("h", false, "print sizes with a unit, e.g. 1.5G")
+	allversions := fs.Bool("a", false, "count all generations of files in a versioned bucket, not only the live ones")
+	checkpoint := fs.String("checkpoint", "", "keep progress in file, and continue from it after an interruption")
+	args = parseflags(fs, args)
+	if len(args) != 1 {
+		usage()
+	}
+	if *allversions && *checkpoint != "" {
+		fail("-a cannot be combined with -checkpoint")
+	}
+	if *allversions && !googlestorage() {
+		fail("-a needs google cloud storage")
+	}
+	bucket, prefix := splitpath(makepath(args[0]))
+	// Directories are relative to the prefix as a directory.
+	if *dirs && prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	base := "/" + bucket + "/" + prefix
+
+	state := dustate{Dirs: map[string]*dutotal{}}
+	add := func(l []objectinfo) error {
+		for _, o := range l {
+			state.Total.Files++
+			state.Total.Bytes += o.Size
+			if !*dirs {
+				continue
+			}
+			rel := strings.TrimPrefix(o.Name, base)
+			if i := strings.Index(rel, "/"); i >= 0 {
+				d := rel[:i+1]
+				if state.Dirs[d] == nil {
+					state.Dirs[d] = &dutotal{}
+				}
+				state.Dirs[d].Files++
+				state.Dirs[d].Bytes += o.Size
+			}
+		}
+		return nil
+	}
+	var err error
+	if *allversions {
+		err = listpages(bucket, prefix, "", "", true, func(l []objectinfo, marker string) error {
+			return add(l)
+		})
+	} else {
+		err = listcheckpointed(*checkpoint, bucket, prefix, "", &state, add)
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+
+	printline := func(t dutotal, p string) {
+		if *human {
+			fmt.Printf("%8s %10d %s\n", formatsize(t.Bytes), t.Files, p)
+		} else {
+			fmt.Printf("%16d %10d %s\n", t.Bytes, t.Files, p)
+		}
+	}
+	var names []string
+	for d := range state.Dirs {
+		names = append(names, d)
+	}
+	sort.Strings(names)
+	for _, d := range names {
+		printline(*state.Dirs[d], base+d)
+	}
+	printline(state.Total, base)
+}
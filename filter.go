@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Data is passed through a pipeline of filters on put, e.g. compression
+// and encryption.  The pipeline is a comma-separated list of filters,
+// each with an optional parameter after a colon, e.g.
+// "sha256,gzip:9,encrypt:xchacha20-poly1305".  Put applies the filters
+// in order, and stores the pipeline in the filters metadata header.
+// Get reverses the filters in reverse order.
+//
+// Filters:
+//
+//	gzip[:level]	compress with gzip, default level 6
+//	zstd[:level]	compress with zstd, default level 3, faster than gzip
+//	encrypt[:cipher]	encrypt, see crypt.go, default cipher aes-256-gcm
+//	age	encrypt to age recipients, see age.go
+//	sha256	append the sha256 hash of the data, verified by get
+
+// Metadata header holding the filter pipeline.
+const filtersheader = "x-goog-meta-cloudstream-filters"
+
+type filter interface {
+	// Transform data for storing.  Header holds the request headers for
+	// the object, filters can add metadata.
+	encode(r io.Reader, header http.Header) (io.Reader, error)
+
+	// Transform stored data back.  Header holds the response headers
+	// of the object.
+	decode(r io.Reader, header http.Header) (io.Reader, error)
+}
+
+// Parse a pipeline.  Keys is used for the encrypt filter.
+func parsefilters(spec string, keys *keyopts) ([]filter, error) {
+	var filters []filter
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name, param := s, ""
+		if i := strings.Index(s, ":"); i >= 0 {
+			name, param = s[:i], s[i+1:]
+		}
+		var f filter
+		switch name {
+		case "gzip":
+			level := gzip.DefaultCompression
+			if param != "" {
+				var err error
+				level, err = strconv.Atoi(param)
+				if err != nil || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+					return nil, fmt.Errorf("bad gzip level %q", param)
+				}
+			}
+			f = gzipfilter{level}
+		case "zstd":
+			level := 3
+			if param != "" {
+				var err error
+				level, err = strconv.Atoi(param)
+				if err != nil || level < 1 || level > 22 {
+					return nil, fmt.Errorf("bad zstd level %q", param)
+				}
+			}
+			f = zstdfilter{level}
+		case "encrypt":
+			if param == "" {
+				param = "aes-256-gcm"
+			}
+			if _, ok := ciphers[param]; !ok {
+				return nil, fmt.Errorf("unknown cipher %q", param)
+			}
+			f = encryptfilter{keys, param}
+		case "age":
+			if param != "" {
+				return nil, fmt.Errorf("filter age does not take a parameter")
+			}
+			f = agefilter{keys}
+		case "sha256":
+			if param != "" {
+				return nil, fmt.Errorf("filter sha256 does not take a parameter")
+			}
+			f = sha256filter{}
+		default:
+			return nil, fmt.Errorf("unknown filter %q", name)
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// Apply the pipeline for storing the data in r.
+func encodefilters(filters []filter, r io.Reader, header http.Header) (io.Reader, error) {
+	for _, f := range filters {
+		var err error
+		r, err = f.encode(r, header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Reverse the pipeline on the stored data in r.
+func decodefilters(filters []filter, r io.Reader, header http.Header) (io.Reader, error) {
+	for i := len(filters) - 1; i >= 0; i-- {
+		var err error
+		r, err = filters[i].decode(r, header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+type gzipfilter struct {
+	level int
+}
+
+func (f gzipfilter) encode(r io.Reader, header http.Header) (io.Reader, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		gw, err := gzip.NewWriterLevel(pw, f.level)
+		if err == nil {
+			_, err = io.Copy(gw, r)
+		}
+		if err == nil {
+			err = gw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func (f gzipfilter) decode(r io.Reader, header http.Header) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdfilter struct {
+	level int
+}
+
+func (f zstdfilter) encode(r io.Reader, header http.Header) (io.Reader, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := zstd.NewWriter(pw, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(f.level)))
+		if err == nil {
+			_, err = io.Copy(zw, r)
+			if cerr := zw.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func (f zstdfilter) decode(r io.Reader, header http.Header) (io.Reader, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+// External command, run with sh -c, as given with put -filter-put and get
+// -filter-get.  The command is not stored, get must be told the command
+// reversing it.
+type execfilter struct {
+	put, get string
+}
+
+func (f execfilter) encode(r io.Reader, header http.Header) (io.Reader, error) {
+	return runfilter(f.put, r)
+}
+
+func (f execfilter) decode(r io.Reader, header http.Header) (io.Reader, error) {
+	return runfilter(f.get, r)
+}
+
+// Run command with r as stdin, returning its stdout.  A failing command
+// is a read error after its output.
+func runfilter(command string, r io.Reader) (io.Reader, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting filter command: %v", err)
+	}
+	return &execreader{cmd: cmd, stdout: stdout, command: command}, nil
+}
+
+type execreader struct {
+	cmd     *exec.Cmd
+	stdout  io.Reader
+	command string
+	err     error // Final error, once stdout is done.
+}
+
+func (er *execreader) Read(buf []byte) (int, error) {
+	if er.err != nil {
+		return 0, er.err
+	}
+	n, err := er.stdout.Read(buf)
+	if err == io.EOF {
+		if werr := er.cmd.Wait(); werr != nil {
+			err = fmt.Errorf("filter command %q: %v", er.command, werr)
+		}
+	}
+	if err != nil {
+		er.err = err
+	}
+	return n, err
+}
+
+// Data is stored with Content-Encoding gzip by put -gzip, for other
+// clients to decompress.  Get asks for the stored data with
+// Accept-Encoding, to verify its hashes, and for ranges of it.  Otherwise
+// Google Cloud Storage decompresses it, and Go's http client would
+// transparently decompress only some responses.
+func acceptgzip(header http.Header) http.Header {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Accept-Encoding", "gzip")
+	return header
+}
+
+// Reverse a Content-Encoding of gzip in the response headers h.
+func contentdecode(r io.Reader, h http.Header) (io.Reader, error) {
+	if strings.EqualFold(h.Get("Content-Encoding"), "gzip") {
+		return gzip.NewReader(r)
+	}
+	return r, nil
+}
+
+type encryptfilter struct {
+	keys   *keyopts
+	cipher string
+}
+
+func (f encryptfilter) encode(r io.Reader, header http.Header) (io.Reader, error) {
+	if !f.keys.enabled() {
+		return nil, errors.New("encrypt filter needs -key-file or a passphrase")
+	}
+	key, wrapped, err := f.keys.newdatakey()
+	if err != nil {
+		return nil, err
+	}
+	header.Set(encryptionheader, wrapped)
+	return newencryptreader(r, key, f.cipher)
+}
+
+func (f encryptfilter) decode(r io.Reader, header http.Header) (io.Reader, error) {
+	wrapped := header.Get(encryptionheader)
+	if wrapped == "" {
+		return nil, errors.New("missing encryption metadata")
+	}
+	key, err := f.keys.datakey(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return newdecryptreader(r, key), nil
+}
+
+type sha256filter struct{}
+
+func (sha256filter) encode(r io.Reader, header http.Header) (io.Reader, error) {
+	h := sha256.New()
+	var sum io.Reader
+	trailer := readerfunc(func(buf []byte) (int, error) {
+		if sum == nil {
+			sum = bytes.NewReader(h.Sum(nil))
+		}
+		return sum.Read(buf)
+	})
+	return io.MultiReader(io.TeeReader(r, h), trailer), nil
+}
+
+func (sha256filter) decode(r io.Reader, header http.Header) (io.Reader, error) {
+	return &hashcheckreader{r: r, h: sha256.New(), buf: make([]byte, 32*1024)}, nil
+}
+
+type readerfunc func(buf []byte) (int, error)
+
+func (f readerfunc) Read(buf []byte) (int, error) {
+	return f(buf)
+}
+
+// Reader that holds back the trailing sha256 hash of the data, and
+// verifies it at the end.
+type hashcheckreader struct {
+	r   io.Reader
+	h   hash.Hash
+	buf []byte // The last sha256.Size bytes read are possibly the hash.
+	n   int    // Bytes in buf.
+	eof bool
+}
+
+func (hr *hashcheckreader) Read(buf []byte) (int, error) {
+	for hr.n <= sha256.Size && !hr.eof {
+		n, err := hr.r.Read(hr.buf[hr.n:])
+		hr.n += n
+		if err == io.EOF {
+			hr.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if hr.n < sha256.Size {
+		return 0, errors.New("data too short for sha256 trailer")
+	}
+	avail := hr.n - sha256.Size
+	if avail == 0 {
+		if !bytes.Equal(hr.h.Sum(nil), hr.buf[:hr.n]) {
+			return 0, errors.New("sha256 mismatch, data corrupted")
+		}
+		return 0, io.EOF
+	}
+	n := copy(buf, hr.buf[:avail])
+	hr.h.Write(hr.buf[:n])
+	hr.n = copy(hr.buf, hr.buf[n:hr.n])
+	return n, nil
+}
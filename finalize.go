@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Name of the marker of a finalized backup set, in the prefix of the set.
+// It is written by "sync -finalize" only after all files of the set were
+// uploaded and verified.
+const donemarker = ".cloudstream-done"
+
+// Contents of a done marker.
+type backupset struct {
+	Finalized time.Time
+	Files     []backupfile
+}
+
+type backupfile struct {
+	Name       string // Relative to the prefix of the set.
+	Size       int64
+	Generation int64
+	SHA256     string // Hex.
+}
+
+// Remove the done marker of the set at bucket and prefix, before the set
+// is changed.
+func removedone(bucket, prefix string) error {
+	err := deleteobject("/"+bucket+"/"+prefix+donemarker, nil)
+	if iserrorstatus(err, 404) {
+		return nil
+	}
+	return err
+}
+
+// Verify that the remote files of the set at bucket and prefix match
+// the local files, by size and sha256, and write the done marker.
+func writedone(bucket, prefix string, files []syncfile, cache *digestcache) error {
+	set := backupset{Finalized: time.Now().UTC()}
+	for _, f := range files {
+		p := "/" + bucket + "/" + prefix + f.Name
+		h, err := head(p)
+		if err != nil {
+			return fmt.Errorf("verifying %s: %v", p, err)
+		}
+		d, err := cache.digest(f)
+		if err != nil {
+			return err
+		}
+		if s := h.Get("Content-Length"); s != fmt.Sprintf("%d", f.Size) {
+			return fmt.Errorf("verifying %s: size %s, expected %d", p, s, f.Size)
+		}
+		if s := h.Get(sha256header); s != d.SHA256 {
+			return fmt.Errorf("verifying %s: sha256 %q, expected %s", p, s, d.SHA256)
+		}
+		var generation int64
+		fmt.Sscan(h.Get("x-goog-generation"), &generation)
+		set.Files = append(set.Files, backupfile{f.Name, f.Size, generation, d.SHA256})
+	}
+	buf, err := json.MarshalIndent(set, "", "\t")
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	resp, err := request("PUT", escapepath("/"+bucket+"/"+prefix+donemarker), header, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return statuserror(resp)
+	}
+	return nil
+}
+
+// Whether the set at bucket and prefix has a done marker.
+func finalized(bucket, prefix string) (bool, error) {
+	_, err := head("/" + bucket + "/" + prefix + donemarker)
+	if err == nil {
+		return true, nil
+	} else if iserrorstatus(err, 404) {
+		return false, nil
+	}
+	return false, err
+}
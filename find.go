@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Print files under a prefix matching conditions on age, size and name,
+// e.g. for removing old backups, or fetching matching files, with batch.
+func find(args []string) {
+	fs := flag.NewFlagSet("find", flag.ExitOnError)
+	fs.Usage = usage
+	var newerthan, olderthan durationflag
+	fs.Var(&newerthan, "newer-than", "only files modified less than duration ago, e.g. 12h or 30d")
+	fs.Var(&olderthan, "older-than", "only files modified more than duration ago, e.g. 12h or 30d")
+	largerthan := size(-1)
+	fs.Var(&largerthan, "larger-than", "only files larger than size, e.g. 1G")
+	smallerthan := size(-1)
+	fs.Var(&smallerthan, "smaller-than", "only files smaller than size, e.g. 1G")
+	name := fs.String("name", "", "only files with a name, the part after the last slash, matching the pattern, e.g. '*.tar.zst'")
+	long := fs.Bool("l", false, "long listing, with size and modification time")
+	batchop := fs.String("batch", "", "print operations for batch instead of paths: rm, or get with -batch-dir")
+	batchdir := fs.String("batch-dir", "", "local directory for -batch get, files are stored under their path relative to the prefix")
+	args = parseflags(fs, args)
+	if len(args) != 1 {
+		usage()
+	}
+	switch *batchop {
+	case "", "rm":
+		if *batchdir != "" {
+			fail("-batch-dir is only for -batch get")
+		}
+	case "get":
+		if *batchdir == "" {
+			fail("-batch get needs -batch-dir")
+		}
+	default:
+		fail("-batch must be rm or get")
+	}
+	if *batchop != "" && *long {
+		fail("-batch cannot be combined with -l")
+	}
+	if _, err := path.Match(*name, ""); err != nil {
+		fail(fmt.Sprintf("bad -name pattern %q: %s", *name, err))
+	}
+	bucket, prefix := splitpath(makepath(args[0]))
+
+	now := time.Now()
+	match := func(o objectinfo) bool {
+		switch {
+		case newerthan > 0 && !o.Modified.After(now.Add(-time.Duration(newerthan))),
+			olderthan > 0 && !o.Modified.Before(now.Add(-time.Duration(olderthan))),
+			largerthan >= 0 && o.Size <= int64(largerthan),
+			smallerthan >= 0 && o.Size >= int64(smallerthan):
+			return false
+		}
+		if *name != "" {
+			ok, _ := path.Match(*name, path.Base(o.Name))
+			return ok
+		}
+		return true
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	err := listobjects(bucket, prefix, "", "", func(l []objectinfo, marker string) error {
+		for _, o := range l {
+			if !match(o) {
+				continue
+			}
+			switch *batchop {
+			case "rm":
+				fmt.Fprintf(out, "rm %s\n", batchquote(o.Name))
+				continue
+			case "get":
+				rel := strings.TrimPrefix(strings.TrimPrefix(o.Name, "/"+bucket+"/"+prefix), "/")
+				lpath, err := localpath(*batchdir, rel)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "get %s %s\n", batchquote(o.Name), batchquote(lpath))
+				continue
+			}
+			if *long {
+				fmt.Fprintf(out, "%12d %20s ", o.Size, o.Modified.UTC().Format(time.RFC3339))
+			}
+			fmt.Fprintln(out, o.Name)
+		}
+		return out.Flush()
+	})
+	if err != nil {
+		fail(err.Error())
+	}
+}
+
+// Duration as flag.  Besides the formats of time.ParseDuration, a
+// number of days is accepted, e.g. "30d".
+type durationflag time.Duration
+
+func (a *durationflag) String() string {
+	return time.Duration(*a).String()
+}
+
+func (a *durationflag) Set(v string) error {
+	if strings.HasSuffix(v, "d") {
+		n, err := strconv.ParseFloat(strings.TrimSuffix(v, "d"), 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad number of days %q", v)
+		}
+		*a = durationflag(n * float64(24*time.Hour))
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*a = durationflag(d)
+	return nil
+}
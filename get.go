@@ -0,0 +1,392 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func get(args []string) {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	fs.Usage = usage
+	offset := fs.Int64("offset", 0, "start reading at byte offset")
+	maxduration := fs.Duration("max-duration", 0, "stop the download after duration, printing how to continue")
+	keys := keyflags(fs, "")
+	fs.StringVar(&keys.identityfile, "identity", "", "file with age identities, for decrypting files encrypted with age")
+	raw := fs.Bool("raw", false, "write the data as stored, without reversing filters or gzip content-encoding")
+	joined := fs.Bool("joined", false, "path is a manifest, write the concatenation of its parts")
+	concurrency := fs.Int("concurrency", 4, "number of concurrent ranged requests for a large file, parts of a -joined file, or files with -r")
+	recursive := fs.Bool("r", false, "download the files under a prefix to a local directory")
+	showprogress := fs.Bool("progress", false, "print progress of the download to stderr")
+	output := fs.String("o", "", "write to file instead of stdout")
+	resume := fs.Bool("resume", false, "continue a partial download in the -o file, starting at its size")
+	filterget := fs.String("filter-get", "", "shell command to pass the data through after reversing filters, e.g. \"zstd -d\"")
+	noverify := fs.Bool("no-verify", false, "do not compare the crc32c and md5 of the downloaded data with those of the remote file")
+	generation := fs.Int64("generation", 0, "fetch this generation of the file, e.g. an old version in a versioned bucket")
+	csek, _ := csekflags(fs, false)
+	onerror := onerrorflag(fs)
+	args = parseflags(fs, args)
+	if !*recursive && len(args) != 1 || *recursive && len(args) != 2 || *offset < 0 {
+		usage()
+	}
+	setcsek(*csek)
+	if *onerror == "retry-later" {
+		fail("-on-error retry-later needs a state file, see sync")
+	}
+	checkonerror(*onerror, "")
+	if *generation != 0 && (*recursive || *joined || *resume) {
+		fail("-generation cannot be combined with -r, -joined or -resume")
+	}
+	if *generation != 0 && !googlestorage() {
+		fail("-generation needs google cloud storage")
+	}
+	if *filterget != "" && (*recursive || *joined || *resume || *offset > 0 || *maxduration > 0) {
+		fail("-filter-get cannot be combined with -r, -joined, -resume, -offset or -max-duration")
+	}
+
+	if *recursive {
+		if *offset > 0 || *maxduration > 0 || *joined {
+			fail("-r cannot be combined with -offset, -max-duration or -joined")
+		}
+		// Ask for a passphrase once, before downloads start concurrently.
+		if keys.usepassphrase() && !*raw {
+			if _, err := keys.passphrase(false); err != nil {
+				fail(err.Error())
+			}
+		}
+		bucket, prefix := splitpath(makepath(args[0]))
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		getrecursive(bucket, prefix, args[1], keys, *raw, !*noverify, *concurrency, *onerror)
+		return
+	}
+	path := makepath(args[0])
+
+	if *output != "" && *offset > 0 || *resume && *output == "" {
+		fail("-o cannot be combined with -offset, -resume needs -o")
+	}
+	if *resume {
+		if *joined {
+			fail("-resume cannot be combined with -joined")
+		}
+		getresume(path, *output, *raw, !*noverify, *showprogress, *maxduration)
+		return
+	}
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		// Don't throw away a partial download, or another file.
+		if fi, err := os.Stat(*output); err == nil && fi.Mode().IsRegular() && fi.Size() > 0 {
+			fail(fmt.Sprintf("%s: file exists, continue a partial download with -resume, or remove the file", *output))
+		}
+		f, err := os.Create(*output)
+		if err != nil {
+			fail(err.Error())
+		}
+		out = f
+		defer func() {
+			if err := f.Close(); err != nil {
+				fail(err.Error())
+			}
+		}()
+	}
+
+	if *joined {
+		if *offset > 0 || *maxduration > 0 {
+			fail("-joined cannot be combined with -offset or -max-duration")
+		}
+		getjoined(out, path, keys, *raw, *concurrency)
+		return
+	}
+
+	var header http.Header
+	if *offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", *offset)}}
+	}
+
+	// With an explicit -concurrency, a large file is fetched with ranged
+	// requests, the first part with the request below, the remainder
+	// through a parallel reader.  The etag ensures all requests are for
+	// the same version of the file.
+	var parallel bool
+	fs.Visit(func(f *flag.Flag) {
+		parallel = parallel || f.Name == "concurrency"
+	})
+	if parallel && *generation != 0 {
+		fail("-generation cannot be combined with -concurrency")
+	}
+	var rest *parallelreader
+	var total int64 = -1
+	var expected googhash
+	if parallel && *concurrency > 1 {
+		h, err := head(path)
+		if err != nil {
+			fail(err.Error())
+		}
+		size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		if err != nil {
+			fail("bad content-length of remote file")
+		}
+		if size-*offset > chunksize {
+			etag := h.Get("ETag")
+			header = http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", *offset, *offset+chunksize-1)}, "If-Match": {etag}}
+			start := *offset + chunksize
+			total = size - *offset
+			expected = expectedhash(h)
+			rest = newparallelreader(size-start, chunksize, *concurrency, func(o, n int64) ([]byte, error) {
+				return fetchobjectrange(path, start+o, n, etag)
+			})
+			defer rest.Close()
+		}
+	}
+
+	query := ""
+	if *generation != 0 {
+		query = fmt.Sprintf("?generation=%d", *generation)
+	}
+	resp, err := request("GET", escapepath(path)+query, acceptgzip(header), nil)
+	if err != nil {
+		fail(err.Error())
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 206 {
+		writeresponse(resp)
+		return
+	}
+	defer resp.Body.Close()
+	var body io.Reader = resp.Body
+	if rest != nil {
+		body = io.MultiReader(resp.Body, rest)
+	} else {
+		expected = expectedhash(resp.Header)
+	}
+	// Only a complete file can be verified.
+	var vr *verifyreader
+	if !*noverify && *offset == 0 {
+		vr = newverifyreader(body, expected)
+		body = vr
+	}
+	var p *progress
+	if *showprogress {
+		if total < 0 {
+			total = resp.ContentLength
+		}
+		p = newprogress(total)
+		body = p.reader(body)
+	}
+
+	if !*raw && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		if *offset > 0 || *maxduration > 0 {
+			fail("gzip-encoded files can only be read as a whole, -offset and -max-duration cannot be used, see -raw")
+		}
+		r, err := contentdecode(body, resp.Header)
+		if err != nil {
+			fail(err.Error())
+		}
+		body = r
+	}
+
+	if spec := resp.Header.Get(filtersheader); spec != "" && !*raw {
+		if *offset > 0 || *maxduration > 0 {
+			fail("filtered files can only be read as a whole, -offset and -max-duration cannot be used, see -raw")
+		}
+		filters, err := parsefilters(spec, keys)
+		if err != nil {
+			fail(err.Error())
+		}
+		r, err := decodefilters(filters, body, resp.Header)
+		if err != nil {
+			fail(err.Error())
+		}
+		if *filterget != "" {
+			r, err = runfilter(*filterget, r)
+			if err != nil {
+				fail(err.Error())
+			}
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			fail(err.Error())
+		}
+		if vr != nil {
+			if err := vr.verify(); err != nil {
+				fail(err.Error())
+			}
+		}
+		if p != nil {
+			p.finish()
+		}
+		return
+	}
+
+	if *filterget != "" {
+		body, err = runfilter(*filterget, body)
+		if err != nil {
+			fail(err.Error())
+		}
+	}
+	if *maxduration == 0 {
+		if _, err := io.Copy(out, body); err != nil {
+			fail(err.Error())
+		}
+		if vr != nil {
+			if err := vr.verify(); err != nil {
+				fail(err.Error())
+			}
+		}
+		if p != nil {
+			p.finish()
+		}
+		return
+	}
+
+	n, expired, err := copyuntil(out, body, time.Now().Add(*maxduration))
+	if err != nil {
+		fail(err.Error())
+	}
+	if p != nil {
+		p.finish()
+	}
+	if !expired && vr != nil {
+		if err := vr.verify(); err != nil {
+			fail(err.Error())
+		}
+	}
+	if expired {
+		if *output != "" {
+			checkpoint(fmt.Sprintf("cloudstream get -o %s -resume %s", *output, path))
+		}
+		checkpoint(fmt.Sprintf("cloudstream get -offset %d %s", *offset+n, path))
+	}
+}
+
+// Continue downloading path into local file lpath, starting at its size,
+// and verify the hashes of the complete file.  The file must be of the
+// same version of path, which must not be replaced in the meantime.
+func getresume(path, lpath string, raw, verify, showprogress bool, maxduration time.Duration) {
+	h, err := head(path)
+	if err != nil {
+		fail(err.Error())
+	}
+	if h.Get(filtersheader) != "" && !raw {
+		fail("filtered files can only be read as a whole, they cannot be resumed, see -raw")
+	}
+	if strings.EqualFold(h.Get("Content-Encoding"), "gzip") && !raw {
+		fail("gzip-encoded files can only be read as a whole, they cannot be resumed, see -raw")
+	}
+	size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil {
+		fail("bad content-length of remote file")
+	}
+
+	f, err := os.OpenFile(lpath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		fail(err.Error())
+	}
+	defer f.Close()
+	// The data already downloaded is hashed for verifying the file as a
+	// whole, otherwise only its size is needed.
+	var w io.Writer = f
+	hr := newhasher()
+	var n int64
+	if verify {
+		n, err = io.Copy(hr, f)
+		w = io.MultiWriter(f, hr)
+	} else {
+		n, err = f.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+	if n > size {
+		fail(fmt.Sprintf("%s has %d bytes, more than the %d of the remote file, it is not a partial download of it", lpath, n, size))
+	}
+
+	var p *progress
+	if showprogress {
+		p = newprogress(size)
+		atomic.StoreInt64(&p.n, n)
+	}
+	if n < size {
+		// The etag (and generation) changes when the file is replaced.
+		header := acceptgzip(http.Header{"Range": {fmt.Sprintf("bytes=%d-", n)}, "If-Match": {h.Get("ETag")}})
+		resp, err := request("GET", escapepath(path), header, nil)
+		if err != nil {
+			fail(err.Error())
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == 412 {
+			fail("remote file changed since the partial download, remove " + lpath + " and download again")
+		} else if resp.StatusCode != 206 {
+			fail(statuserror(resp).Error())
+		}
+		var body io.Reader = resp.Body
+		if p != nil {
+			body = p.reader(body)
+		}
+		if maxduration == 0 {
+			_, err = io.Copy(w, body)
+		} else {
+			var expired bool
+			_, expired, err = copyuntil(w, body, time.Now().Add(maxduration))
+			if err == nil && expired {
+				if err := f.Close(); err != nil {
+					fail(err.Error())
+				}
+				if p != nil {
+					p.finish()
+				}
+				flags := ""
+				if !verify {
+					flags = "-no-verify "
+				}
+				checkpoint(fmt.Sprintf("cloudstream get %s-o %s -resume %s", flags, lpath, path))
+			}
+		}
+		if err != nil {
+			fail(err.Error())
+		}
+	}
+	if p != nil {
+		p.finish()
+	}
+	if err := f.Close(); err != nil {
+		fail(err.Error())
+	}
+	if !verify {
+		return
+	}
+	if msg := expectedhash(h).mismatch(hr.sum()); msg != "" {
+		fail(fmt.Sprintf("%s: %s, remove it and download again", lpath, msg))
+	}
+}
+
+// Copy src to dst until EOF or until deadline has passed.  Returns the
+// number of bytes copied, and whether the deadline cut the copy short.
+func copyuntil(dst io.Writer, src io.Reader, deadline time.Time) (int64, bool, error) {
+	buf := make([]byte, 32*1024)
+	var n int64
+	for {
+		if time.Now().After(deadline) {
+			return n, true, nil
+		}
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, false, werr
+			}
+		}
+		if err == io.EOF {
+			return n, false, nil
+		}
+		if err != nil {
+			return n, false, err
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Hashes of an object as in the x-goog-hash header: base64-encoded crc32c
+// (big-endian) and md5.  Empty if unknown, composite objects have no md5.
+type googhash struct {
+	crc32c string
+	md5    string
+}
+
+func parsegooghash(h http.Header) googhash {
+	var gh googhash
+	for _, v := range h.Values("x-goog-hash") {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			switch {
+			case strings.HasPrefix(s, "crc32c="):
+				gh.crc32c = s[len("crc32c="):]
+			case strings.HasPrefix(s, "md5="):
+				gh.md5 = s[len("md5="):]
+			}
+		}
+	}
+	return gh
+}
+
+// Writer computing the hashes of x-goog-hash.
+type hasher struct {
+	crc hash.Hash32
+	md5 hash.Hash
+}
+
+func newhasher() *hasher {
+	return &hasher{crc32.New(castagnoli), md5.New()}
+}
+
+func (h *hasher) Write(buf []byte) (int, error) {
+	h.crc.Write(buf)
+	h.md5.Write(buf)
+	return len(buf), nil
+}
+
+func (h *hasher) sum() googhash {
+	crc := binary.BigEndian.AppendUint32(nil, h.crc.Sum32())
+	return googhash{
+		base64.StdEncoding.EncodeToString(crc),
+		base64.StdEncoding.EncodeToString(h.md5.Sum(nil)),
+	}
+}
+
+// Hashes of buf.
+func datahash(buf []byte) googhash {
+	h := newhasher()
+	h.Write(buf)
+	return h.sum()
+}
+
+// Hashes of the data of f from its current offset, after which f is at
+// that offset again.
+func filehash(f *os.File) (googhash, error) {
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return googhash{}, err
+	}
+	h := newhasher()
+	if _, err := io.Copy(h, f); err != nil {
+		return googhash{}, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return googhash{}, err
+	}
+	return h.sum(), nil
+}
+
+// Value for an x-goog-hash request header, for the server to reject data
+// that does not match.
+func (gh googhash) header() string {
+	var l []string
+	if gh.crc32c != "" {
+		l = append(l, "crc32c="+gh.crc32c)
+	}
+	if gh.md5 != "" {
+		l = append(l, "md5="+gh.md5)
+	}
+	return strings.Join(l, ",")
+}
+
+// Compare hashes, returning a description of the mismatch, or empty
+// for a match.  Only hashes present in both are compared.
+func (expected googhash) mismatch(got googhash) string {
+	if expected.crc32c != "" && got.crc32c != "" && expected.crc32c != got.crc32c {
+		return "crc32c mismatch, expected " + expected.crc32c + ", got " + got.crc32c
+	}
+	if expected.md5 != "" && got.md5 != "" && expected.md5 != got.md5 {
+		return "md5 mismatch, expected " + expected.md5 + ", got " + got.md5
+	}
+	return ""
+}
+
+// Expected hashes of the data of a response for a complete object.  For
+// servers other than Google Cloud Storage, without x-goog-hash, the ETag
+// is the md5 of objects not uploaded in parts.
+func expectedhash(h http.Header) googhash {
+	gh := parsegooghash(h)
+	if gh.md5 != "" || googlestorage() {
+		return gh
+	}
+	etag := strings.Trim(h.Get("ETag"), `"`)
+	if buf, err := hex.DecodeString(etag); err == nil && len(buf) == md5.Size {
+		gh.md5 = base64.StdEncoding.EncodeToString(buf)
+	}
+	return gh
+}
+
+// Reader hashing the data read from r, for comparing with the expected
+// hashes of the complete object once all data is read.
+type verifyreader struct {
+	r        io.Reader
+	h        *hasher
+	expected googhash
+}
+
+func newverifyreader(r io.Reader, expected googhash) *verifyreader {
+	return &verifyreader{r, newhasher(), expected}
+}
+
+func (vr *verifyreader) Read(buf []byte) (int, error) {
+	n, err := vr.r.Read(buf)
+	vr.h.Write(buf[:n])
+	return n, err
+}
+
+// Read the remaining data, not consumed by a filter, and compare the
+// hashes.
+func (vr *verifyreader) verify() error {
+	if _, err := io.Copy(io.Discard, vr); err != nil {
+		return err
+	}
+	if msg := vr.expected.mismatch(vr.h.sum()); msg != "" {
+		return errors.New(msg + ", data corrupted")
+	}
+	return nil
+}
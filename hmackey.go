@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+)
+
+type hmackeymetadata struct {
+	AccessID            string `json:"accessId"`
+	ServiceAccountEmail string `json:"serviceAccountEmail"`
+	State               string `json:"state"`
+	TimeCreated         string `json:"timeCreated"`
+	Etag                string `json:"etag"`
+}
+
+func hmackey(args []string) {
+	fs := flag.NewFlagSet("hmackey", flag.ExitOnError)
+	fs.Usage = usage
+	project := fs.String("project", config.Project, "project of the service accounts")
+	args = parseflags(fs, args)
+	if len(args) == 0 {
+		usage()
+	}
+	if *project == "" {
+		fail("need a project, with -project or in the configuration file")
+	}
+	base := "/projects/" + url.PathEscape(*project) + "/hmacKeys"
+
+	cmd, args := args[0], args[1:]
+	var err error
+	switch {
+	case cmd == "create" && len(args) == 1:
+		var key struct {
+			Metadata hmackeymetadata `json:"metadata"`
+			Secret   string          `json:"secret"`
+		}
+		err = jsonrequest("POST", base+"?serviceAccountEmail="+url.QueryEscape(args[0]), nil, &key)
+		if err == nil {
+			// In the format of the configuration file.
+			fmt.Printf("accesskey %s\nsecret %s\n", key.Metadata.AccessID, key.Secret)
+		}
+
+	case cmd == "list" && len(args) <= 1:
+		q := url.Values{}
+		if len(args) == 1 {
+			q.Set("serviceAccountEmail", args[0])
+		}
+		for {
+			var page struct {
+				Items         []hmackeymetadata `json:"items"`
+				NextPageToken string            `json:"nextPageToken"`
+			}
+			p := base
+			if len(q) > 0 {
+				p += "?" + q.Encode()
+			}
+			if err = jsonrequest("GET", p, nil, &page); err != nil {
+				break
+			}
+			for _, k := range page.Items {
+				fmt.Printf("%s %s %s %s\n", k.AccessID, k.State, k.TimeCreated, k.ServiceAccountEmail)
+			}
+			if page.NextPageToken == "" {
+				break
+			}
+			q.Set("pageToken", page.NextPageToken)
+		}
+
+	case (cmd == "activate" || cmd == "deactivate") && len(args) == 1:
+		state := "ACTIVE"
+		if cmd == "deactivate" {
+			state = "INACTIVE"
+		}
+		err = jsonrequest("PUT", base+"/"+url.PathEscape(args[0]), map[string]string{"state": state}, nil)
+
+	case cmd == "delete" && len(args) == 1:
+		err = jsonrequest("DELETE", base+"/"+url.PathEscape(args[0]), nil, nil)
+
+	default:
+		usage()
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+}
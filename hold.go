@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Set or release the temporary hold on the object at path.  A held
+// object cannot be deleted or replaced, e.g. by a lifecycle rule.
+func settemporaryhold(path string, hold bool) error {
+	return jsonrequest("PATCH", jsonobjectpath(path), map[string]bool{"temporaryHold": hold}, nil)
+}
+
+func hold(args []string) {
+	fs := flag.NewFlagSet("hold", flag.ExitOnError)
+	fs.Usage = usage
+	release := fs.Bool("release", false, "release the temporary hold instead of placing it")
+	args = parseflags(fs, args)
+	if len(args) == 0 {
+		usage()
+	}
+	for _, p := range args {
+		if err := settemporaryhold(makepath(p), !*release); err != nil {
+			fail(fmt.Sprintf("%s: %s", p, err))
+		}
+	}
+}
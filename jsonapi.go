@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Some operations, like holds, are only available in the JSON API, which
+// does not accept HMAC signatures, only OAuth2 access tokens.  The token
+// is fetched with the configured service account key, printed by the
+// configured token command, e.g. "gcloud auth print-access-token", or
+// fetched with application default credentials, see credentials.go.
+// Without HMAC key, all requests use the token.
+
+var token struct {
+	sync.Mutex
+	value   string
+	expires time.Time // Zero for tokens from the token command.
+}
+
+func accesstoken() (string, error) {
+	token.Lock()
+	defer token.Unlock()
+	// Fetch a new token a bit before it expires, a request can be slow to
+	// arrive, and long transfers are authorized when they start.
+	if token.value != "" && (token.expires.IsZero() || time.Until(token.expires) > 5*time.Minute) {
+		return token.value, nil
+	}
+	var err error
+	switch {
+	case config.ServiceAccount != "":
+		var k *serviceaccountkey
+		k, err = readserviceaccount(config.ServiceAccount)
+		if err == nil {
+			token.value, token.expires, err = k.token()
+		}
+	case len(config.TokenCommand) > 0:
+		token.value, err = tokencommand()
+		token.expires = time.Time{}
+	default:
+		token.value, token.expires, err = defaulttoken()
+	}
+	if err != nil {
+		token.value = ""
+		return "", err
+	}
+	return token.value, nil
+}
+
+func tokencommand() (string, error) {
+	cmd := exec.Command(config.TokenCommand[0], config.TokenCommand[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running tokencommand: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	tok := strings.TrimSpace(string(out))
+	if tok == "" {
+		return "", errors.New("tokencommand printed no token")
+	}
+	return tok, nil
+}
+
+// Whether requests are authorized with an OAuth2 access token instead of
+// an HMAC signature.
+func usebearer() bool {
+	return config.AccessKey == ""
+}
+
+// Execute a JSON API request for path, relative to /storage/v1.  Body, if
+// not nil, is sent as JSON.  If result is not nil, the JSON response is
+// parsed into it.
+func jsonrequest(method, path string, body, result interface{}) error {
+	if !googlestorage() {
+		return fmt.Errorf("operation needs the JSON API of Google Cloud Storage, not available at endpoint %s", endpoint())
+	}
+	tok, err := accesstoken()
+	if err != nil {
+		return err
+	}
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, "https://storage.googleapis.com/storage/v1"+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return statuserror(resp)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// JSON API path for the object at path, the name is a single escaped path element.
+func jsonobjectpath(path string) string {
+	bucket, name := splitpath(path)
+	return "/b/" + bucket + "/o/" + url.PathEscape(name)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+// The data key of an encrypted object is stored in the encryption
+// metadata header, wrapped (with AES-256-GCM) under the master key.  The
+// header value is one of:
+//
+//	keyfile wrapped
+//	argon2id t=time,m=memory,p=threads salt wrapped
+//
+// With "keyfile", the master key is read from a key file.  With
+// "argon2id", the master key is derived from a passphrase, with the
+// parameters and salt from the header.  Salt and wrapped key are
+// unpadded base64url.
+
+// Argon2id parameters for new passphrase-derived keys: 3 passes over 64MB.
+const (
+	argon2time    = 3
+	argon2memory  = 64 * 1024
+	argon2threads = 4
+)
+
+// Limits to the argon2id parameters of stored files, which come from
+// metadata: a tampered file could otherwise make decryption use
+// unbounded memory (in KiB) or time before the key fails to unwrap.
+const (
+	argon2maxtime   = 16
+	argon2maxmemory = 4 * 1024 * 1024
+)
+
+// Options for the master key, shared by the commands that encrypt and decrypt.
+type keyopts struct {
+	prefix         string // Of the flags, e.g. "new-" for rekey.
+	keyfile        string
+	passphrasefile string
+	passphrasefd   int
+	prompt         bool
+	pass           []byte // Passphrase once read, a descriptor can be read only once.
+
+	// For the age filter, see age.go.
+	recipients   multiflag
+	identityfile string
+}
+
+// Register the flags for a master key.  Prefix is prepended to the flag
+// names.
+func keyflags(fs *flag.FlagSet, prefix string) *keyopts {
+	k := &keyopts{prefix: prefix}
+	fs.StringVar(&k.keyfile, prefix+"key-file", "", "file with the master key for encryption")
+	fs.StringVar(&k.passphrasefile, prefix+"passphrase-file", "", "file with the passphrase to derive the master key from")
+	fs.IntVar(&k.passphrasefd, prefix+"passphrase-fd", -1, "file descriptor to read the passphrase from")
+	fs.BoolVar(&k.prompt, prefix+"passphrase", false, "prompt for the passphrase on the terminal")
+	return k
+}
+
+// Whether a master key or passphrase was specified.
+func (k *keyopts) enabled() bool {
+	return k.keyfile != "" || k.usepassphrase()
+}
+
+func (k *keyopts) usepassphrase() bool {
+	return k.passphrasefile != "" || k.passphrasefd >= 0 || k.prompt
+}
+
+// Read a master key from a file, base64-encoded 32 bytes.  Create one with:
+// head -c 32 /dev/urandom | base64 >key.
+func readkeyfile(p string) ([]byte, error) {
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s: key file must contain 32 bytes, base64-encoded", p)
+	}
+	return key, nil
+}
+
+// Read the passphrase from file, file descriptor or the terminal.  When
+// prompting and confirm is set, the passphrase is asked twice.
+func (k *keyopts) passphrase(confirm bool) ([]byte, error) {
+	if k.pass == nil {
+		pass, err := k.readpassphrase(confirm)
+		if err != nil {
+			return nil, err
+		}
+		k.pass = pass
+	}
+	return k.pass, nil
+}
+
+func (k *keyopts) readpassphrase(confirm bool) ([]byte, error) {
+	var r io.Reader
+	switch {
+	case k.passphrasefile != "":
+		f, err := os.Open(k.passphrasefile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	case k.passphrasefd >= 0:
+		r = os.NewFile(uintptr(k.passphrasefd), "passphrase")
+	default:
+		return promptpassphrase(strings.Replace(k.prefix, "-", " ", -1)+"passphrase", confirm)
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading passphrase: %s", err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	return []byte(line), nil
+}
+
+// Prompt on the terminal, stdin is typically in use for data.
+func promptpassphrase(what string, confirm bool) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening terminal for passphrase: %s", err)
+	}
+	defer tty.Close()
+	read := func(prompt string) ([]byte, error) {
+		fmt.Fprint(tty, prompt)
+		buf, err := term.ReadPassword(int(tty.Fd()))
+		fmt.Fprintln(tty)
+		return buf, err
+	}
+	pass, err := read(what + ": ")
+	if err != nil {
+		return nil, err
+	}
+	if len(pass) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		again, err := read("repeat " + what + ": ")
+		if err != nil {
+			return nil, err
+		}
+		if string(again) != string(pass) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return pass, nil
+}
+
+// Generate a new data key, returning it and its wrapped form for the
+// encryption metadata header.
+func (k *keyopts) newdatakey() ([]byte, string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", err
+	}
+	header, err := k.wrapdatakey(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, header, nil
+}
+
+// Wrap data key, returning the value for the encryption metadata header.
+func (k *keyopts) wrapdatakey(key []byte) (string, error) {
+	var master []byte
+	var header string
+	if k.usepassphrase() {
+		pass, err := k.passphrase(true)
+		if err != nil {
+			return "", err
+		}
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		master = argon2.IDKey(pass, salt, argon2time, argon2memory, argon2threads, 32)
+		header = fmt.Sprintf("argon2id t=%d,m=%d,p=%d %s ", argon2time, argon2memory, argon2threads, base64.RawURLEncoding.EncodeToString(salt))
+	} else {
+		var err error
+		master, err = readkeyfile(k.keyfile)
+		if err != nil {
+			return "", err
+		}
+		header = "keyfile "
+	}
+	w, err := wrapkey(master, key)
+	if err != nil {
+		return "", err
+	}
+	return header + w, nil
+}
+
+// Fetch the data key from an encryption metadata header value.
+func (k *keyopts) datakey(header string) ([]byte, error) {
+	t := strings.Fields(header)
+	switch {
+	case len(t) == 2 && t[0] == "keyfile":
+		if k.keyfile == "" {
+			return nil, fmt.Errorf("file is encrypted with a master key, need -%skey-file", k.prefix)
+		}
+		master, err := readkeyfile(k.keyfile)
+		if err != nil {
+			return nil, err
+		}
+		return unwrapkey(master, t[1])
+
+	case len(t) == 4 && t[0] == "argon2id":
+		if !k.usepassphrase() {
+			return nil, fmt.Errorf("file is encrypted with a passphrase, need -%[1]spassphrase, -%[1]spassphrase-file or -%[1]spassphrase-fd", k.prefix)
+		}
+		var time, memory, threads uint64
+		for _, p := range strings.Split(t[1], ",") {
+			kv := strings.SplitN(p, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("bad argon2id parameters %q", t[1])
+			}
+			v, err := strconv.ParseUint(kv[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad argon2id parameters %q", t[1])
+			}
+			switch kv[0] {
+			case "t":
+				time = v
+			case "m":
+				memory = v
+			case "p":
+				threads = v
+			}
+		}
+		if time == 0 || memory == 0 || threads == 0 || threads > 255 {
+			return nil, fmt.Errorf("bad argon2id parameters %q", t[1])
+		}
+		if time > argon2maxtime || memory > argon2maxmemory {
+			return nil, fmt.Errorf("argon2id parameters %q above limits of t=%d,m=%d", t[1], argon2maxtime, argon2maxmemory)
+		}
+		salt, err := base64.RawURLEncoding.DecodeString(t[2])
+		if err != nil {
+			return nil, fmt.Errorf("bad argon2id salt: %s", err)
+		}
+		pass, err := k.passphrase(false)
+		if err != nil {
+			return nil, err
+		}
+		master := argon2.IDKey(pass, salt, uint32(time), uint32(memory), uint8(threads), 32)
+		return unwrapkey(master, t[3])
+	}
+	return nil, fmt.Errorf("unrecognized encryption metadata %q", header)
+}
+
+func wrapkey(master, key []byte) (string, error) {
+	aead, err := newaead(master)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, key, nil)), nil
+}
+
+func unwrapkey(master []byte, s string) ([]byte, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad wrapped key: %s", err)
+	}
+	aead, err := newaead(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < aead.NonceSize() {
+		return nil, errors.New("bad wrapped key: too short")
+	}
+	key, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("cannot unwrap data key, wrong key or passphrase?")
+	}
+	return key, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Object in a listing.
+type objectinfo struct {
+	Name         string     `json:"name"` // Full path, "/bucket/name".
+	Size         int64      `json:"size"`
+	Modified     time.Time  `json:"modified"`
+	ETag         string     `json:"etag"`
+	Generation   int64      `json:"generation"`
+	StorageClass string     `json:"storageclass,omitempty"`
+	Prefix       bool       `json:"prefix,omitempty"`     // Common prefix when listing with delimiter, a "directory".
+	CustomTime   *time.Time `json:"customtime,omitempty"` // Not in listings, only fetched on request.
+}
+
+// Result of GET Bucket, a page of a listing.
+type listresult struct {
+	IsTruncated          bool
+	NextMarker           string
+	NextGenerationMarker string // When listing versions.
+	Contents             []struct {
+		Key          string
+		Generation   int64
+		LastModified time.Time
+		ETag         string
+		Size         int64
+		StorageClass string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// List objects in bucket starting with prefix, one page at a time.  For
+// each page, fn is called with its objects, and the marker to continue
+// listing after the page.  With a non-empty delimiter, names with the
+// delimiter after the prefix are combined into a single common prefix.
+// Listing starts after marker.
+func listobjects(bucket, prefix, delimiter, marker string, fn func(l []objectinfo, marker string) error) error {
+	return listpages(bucket, prefix, delimiter, marker, false, fn)
+}
+
+// List like listobjects, with versions set including all generations of
+// each object, not only the live one.  Pages of versions cannot be
+// continued with just a marker, it is passed as empty.
+func listpages(bucket, prefix, delimiter, marker string, versions bool, fn func(l []objectinfo, marker string) error) error {
+	var generationmarker string
+	for {
+		q := url.Values{}
+		if versions {
+			q.Set("versions", "true")
+			if generationmarker != "" {
+				q.Set("generation-marker", generationmarker)
+			}
+		}
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if delimiter != "" {
+			q.Set("delimiter", delimiter)
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		p := "/" + bucket
+		if len(q) > 0 {
+			p += "?" + q.Encode()
+		}
+		resp, err := request("GET", p, nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 {
+			err := statuserror(resp)
+			resp.Body.Close()
+			return err
+		}
+		var lr listresult
+		err = xml.NewDecoder(resp.Body).Decode(&lr)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("parsing listing: %s", err)
+		}
+
+		var l []objectinfo
+		for _, c := range lr.Contents {
+			o := objectinfo{
+				Name:         "/" + bucket + "/" + c.Key,
+				Size:         c.Size,
+				Modified:     c.LastModified,
+				ETag:         c.ETag,
+				Generation:   c.Generation,
+				StorageClass: c.StorageClass,
+			}
+			l = append(l, o)
+			marker = c.Key
+		}
+		for _, cp := range lr.CommonPrefixes {
+			l = append(l, objectinfo{Name: "/" + bucket + "/" + cp.Prefix, Prefix: true})
+			if cp.Prefix > marker {
+				marker = cp.Prefix
+			}
+		}
+		if lr.NextMarker != "" {
+			marker = lr.NextMarker
+		}
+		pagemarker := marker
+		if versions {
+			generationmarker = lr.NextGenerationMarker
+			pagemarker = ""
+		}
+		if err := fn(l, pagemarker); err != nil {
+			return err
+		}
+		if !lr.IsTruncated {
+			return nil
+		}
+	}
+}
+
+// Progress of a listing, stored in a checkpoint file.
+type listcheckpoint struct {
+	Bucket string
+	Prefix string
+	Marker string
+	State  json.RawMessage `json:",omitempty"` // Of the job, e.g. running totals.
+}
+
+// List like listobjects, but save progress to checkpoint file p after each
+// page, after fn has processed it.  If p exists, listing continues after
+// the marker it holds.  State, if not nil, is a pointer to the state of
+// the job, it is restored from and saved in the checkpoint.  The file is
+// removed when the listing is complete.  If p is empty, no checkpoints
+// are kept.
+func listcheckpointed(p, bucket, prefix, delimiter string, state interface{}, fn func([]objectinfo) error) error {
+	if p == "" {
+		return listobjects(bucket, prefix, delimiter, "", func(l []objectinfo, marker string) error {
+			return fn(l)
+		})
+	}
+
+	var cp listcheckpoint
+	if buf, err := os.ReadFile(p); err == nil {
+		if err := json.Unmarshal(buf, &cp); err != nil {
+			return fmt.Errorf("parsing checkpoint %s: %s", p, err)
+		}
+		if cp.Bucket != bucket || cp.Prefix != prefix {
+			return fmt.Errorf("checkpoint %s is for /%s/%s, not /%s/%s", p, cp.Bucket, cp.Prefix, bucket, prefix)
+		}
+		if state != nil && cp.State != nil {
+			if err := json.Unmarshal(cp.State, state); err != nil {
+				return fmt.Errorf("parsing state in checkpoint %s: %s", p, err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	err := listobjects(bucket, prefix, delimiter, cp.Marker, func(l []objectinfo, marker string) error {
+		if err := fn(l); err != nil {
+			return err
+		}
+		ncp := listcheckpoint{bucket, prefix, marker, nil}
+		if state != nil {
+			buf, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			ncp.State = buf
+		}
+		return writefileatomic(p, ncp)
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// Write v as json to a temporary file, then rename it to p.
+func writefileatomic(p string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func ls(args []string) {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	fs.Usage = usage
+	recursive := fs.Bool("r", false, "list all files under prefix, not just one level")
+	long := fs.Bool("l", false, "long listing, with size and modification time")
+	jsonlines := fs.Bool("json-lines", false, "print each file as json object on a line")
+	customtime := fs.Bool("custom-time", false, "fetch and print the custom time of each file, with a request per file")
+	checkpoint := fs.String("checkpoint", "", "keep progress in file, and continue from it after an interruption")
+	onlyfinalized := fs.Bool("finalized", false, "only list backup sets, directories, with a done marker written by sync -finalize")
+	allversions := fs.Bool("a", false, "list all generations of files in a versioned bucket, as name#generation")
+	args = parseflags(fs, args)
+	if len(args) != 1 || *onlyfinalized && *recursive {
+		usage()
+	}
+	if *allversions && (*checkpoint != "" || *onlyfinalized || *customtime) {
+		fail("-a cannot be combined with -checkpoint, -finalized or -custom-time")
+	}
+	if *allversions && !googlestorage() {
+		fail("-a needs google cloud storage")
+	}
+	bucket, prefix := splitpath(makepath(args[0]))
+	delimiter := "/"
+	if *recursive {
+		delimiter = ""
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
+	list := func(fn func([]objectinfo) error) error {
+		if *allversions {
+			return listpages(bucket, prefix, delimiter, "", true, func(l []objectinfo, marker string) error {
+				return fn(l)
+			})
+		}
+		return listcheckpointed(*checkpoint, bucket, prefix, delimiter, nil, fn)
+	}
+	err := list(func(l []objectinfo) error {
+		for _, o := range l {
+			name := o.Name
+			if *allversions && !o.Prefix {
+				name = fmt.Sprintf("%s#%d", o.Name, o.Generation)
+			}
+			if *onlyfinalized {
+				if !o.Prefix {
+					continue
+				}
+				_, p := splitpath(o.Name)
+				if done, err := finalized(bucket, p); err != nil {
+					return fmt.Errorf("%s: %s", o.Name, err)
+				} else if !done {
+					continue
+				}
+			}
+			if *customtime && !o.Prefix {
+				h, err := head(o.Name)
+				if err != nil {
+					return fmt.Errorf("%s: %s", o.Name, err)
+				}
+				if t, err := time.Parse(time.RFC3339, h.Get("x-goog-custom-time")); err == nil {
+					o.CustomTime = &t
+				}
+			}
+			switch {
+			case *jsonlines:
+				if err := enc.Encode(o); err != nil {
+					return err
+				}
+			case *long && o.Prefix:
+				fmt.Fprintf(out, "%12s %20s %s\n", "", "", name)
+			case *long:
+				fmt.Fprintf(out, "%12d %20s ", o.Size, o.Modified.UTC().Format(time.RFC3339))
+				if *customtime {
+					ct := "-"
+					if o.CustomTime != nil {
+						ct = o.CustomTime.UTC().Format(time.RFC3339)
+					}
+					fmt.Fprintf(out, "%20s ", ct)
+				}
+				fmt.Fprintln(out, name)
+			default:
+				fmt.Fprintln(out, name)
+			}
+		}
+		return out.Flush()
+	})
+	if err != nil {
+		fail(err.Error())
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Manifest of a file stored in parts, e.g. by split or a composite
+// upload, stored as JSON.  The file is the concatenation of the parts.
+// If filters are set, they were applied to the file as a whole, with
+// their metadata, e.g. the wrapped data key, stored with the manifest.
+type manifest struct {
+	Size    int64          `json:"size"`
+	Filters string         `json:"filters,omitempty"`
+	Parts   []manifestpart `json:"parts"`
+}
+
+type manifestpart struct {
+	Path   string `json:"path"` // "/bucket/name", or a name relative to the directory of the manifest.
+	Size   int64  `json:"size"`
+	CRC32C string `json:"crc32c,omitempty"` // Base64, as in x-goog-hash.
+	MD5    string `json:"md5,omitempty"`
+}
+
+// Fetch the manifest at path, returning it with the headers of the
+// manifest file.  Relative part paths are resolved.
+func readmanifest(p string) (*manifest, http.Header, error) {
+	resp, err := request("GET", escapepath(p), nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, nil, statuserror(resp)
+	}
+	var m manifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(&m); err != nil {
+		return nil, nil, fmt.Errorf("parsing manifest: %v", err)
+	}
+	var size int64
+	for i, mp := range m.Parts {
+		if mp.Size < 0 {
+			return nil, nil, fmt.Errorf("bad size %d for part %s", mp.Size, mp.Path)
+		}
+		if !strings.HasPrefix(mp.Path, "/") {
+			m.Parts[i].Path = path.Dir(p) + "/" + mp.Path
+		}
+		size += mp.Size
+	}
+	if size != m.Size {
+		return nil, nil, fmt.Errorf("parts of manifest add up to %d bytes, manifest has size %d", size, m.Size)
+	}
+	return &m, resp.Header, nil
+}
+
+// Reader returning the concatenated data of the parts of m, fetched in
+// chunks with up to concurrency requests at a time.  The data of each
+// part is checked against the hashes in the manifest.
+func newjoinedreader(m *manifest, concurrency int) io.ReadCloser {
+	starts := make([]int64, len(m.Parts))
+	var offset int64
+	for i, mp := range m.Parts {
+		starts[i] = offset
+		offset += mp.Size
+	}
+	fetch := func(offset, n int64) ([]byte, error) {
+		buf := make([]byte, 0, n)
+		// First part with data at offset.
+		i := sort.Search(len(starts), func(i int) bool { return starts[i]+m.Parts[i].Size > offset })
+		for ; n > 0 && i < len(m.Parts); i++ {
+			mp := m.Parts[i]
+			o := offset - starts[i]
+			l := mp.Size - o
+			if l > n {
+				l = n
+			}
+			if l <= 0 {
+				continue
+			}
+			data, err := fetchobjectrange(mp.Path, o, l, "")
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", mp.Path, err)
+			}
+			buf = append(buf, data...)
+			offset += l
+			n -= l
+		}
+		return buf, nil
+	}
+	pr := newparallelreader(m.Size, chunksize, concurrency, fetch)
+	return &partcheckreader{r: pr, parts: m.Parts, h: newhasher()}
+}
+
+// Fetch n bytes at offset of object path with a ranged request.  If etag
+// is not empty, the request fails if the object has another etag.
+func fetchobjectrange(path string, offset, n int64, etag string) ([]byte, error) {
+	header := acceptgzip(http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+n-1)}})
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	resp, err := request("GET", escapepath(path), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 206 && resp.StatusCode != 200 {
+		return nil, statuserror(resp)
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, n+1))
+	if err == nil && int64(len(buf)) != n {
+		err = fmt.Errorf("read %d bytes, expected %d", len(buf), n)
+	}
+	return buf, err
+}
+
+// Reader hashing the data of consecutive parts, failing when a part
+// does not match the hashes of the manifest.
+type partcheckreader struct {
+	r     *parallelreader
+	parts []manifestpart
+	h     *hasher
+	n     int64 // Bytes read of current part.
+}
+
+func (r *partcheckreader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	data := buf[:n]
+	for {
+		// Check the parts that are complete, including empty parts.
+		for len(r.parts) > 0 && r.n == r.parts[0].Size {
+			mp := r.parts[0]
+			if s := (googhash{mp.CRC32C, mp.MD5}).mismatch(r.h.sum()); s != "" {
+				return n, fmt.Errorf("part %s: %s", mp.Path, s)
+			}
+			r.parts = r.parts[1:]
+			r.h = newhasher()
+			r.n = 0
+		}
+		if len(data) == 0 {
+			break
+		}
+		if len(r.parts) == 0 {
+			return n, fmt.Errorf("more data than in manifest")
+		}
+		l := r.parts[0].Size - r.n
+		if l > int64(len(data)) {
+			l = int64(len(data))
+		}
+		r.h.Write(data[:l])
+		r.n += l
+		data = data[l:]
+	}
+	if err == io.EOF && len(r.parts) > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *partcheckreader) Close() error {
+	return r.r.Close()
+}
+
+// Write the file described by the manifest at path to stdout.
+func getjoined(out io.Writer, path string, keys *keyopts, raw bool, concurrency int) {
+	m, header, err := readmanifest(path)
+	if err != nil {
+		fail(fmt.Sprintf("%s: %s", path, err))
+	}
+	r := newjoinedreader(m, concurrency)
+	defer r.Close()
+	var src io.Reader = r
+	if m.Filters != "" && !raw {
+		filters, err := parsefilters(m.Filters, keys)
+		if err != nil {
+			fail(err.Error())
+		}
+		src, err = decodefilters(filters, src, header)
+		if err != nil {
+			fail(err.Error())
+		}
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		fail(err.Error())
+	}
+}
+
+// Upload src as parts of partsize bytes named dst.000, dst.001, etc.,
+// and a manifest at dst.  Header holds the headers for the manifest, and
+// the filter metadata.  Preconditions only apply to the manifest.  If an
+// upload fails, the parts already stored are removed.
+func putsplit(dst string, header http.Header, src io.Reader, partsize int64, spec string) {
+	m := manifest{Filters: spec, Parts: []manifestpart{}}
+	cleanup := func() {
+		for _, mp := range m.Parts {
+			p := path.Dir(dst) + "/" + mp.Path
+			if err := deleteobject(p, nil); err != nil {
+				fmt.Fprintf(os.Stderr, "removing part %s: %s\n", p, err)
+			}
+		}
+	}
+
+	// Parts get the headers about storage, like the acl and encryption key,
+	// not those about the file as a whole.
+	ph := http.Header{}
+	for k, v := range header {
+		switch lk := strings.ToLower(k); {
+		case lk == "content-type", lk == "x-goog-hash", lk == "x-goog-if-generation-match", strings.HasPrefix(lk, "x-goog-meta-"):
+		default:
+			ph[k] = v
+		}
+	}
+	br := bufio.NewReader(src)
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			cleanup()
+			fail(err.Error())
+		}
+		name := fmt.Sprintf("%s.%03d", path.Base(dst), len(m.Parts))
+		p := path.Dir(dst) + "/" + name
+		h := newhasher()
+		lr := &io.LimitedReader{R: br, N: partsize}
+		resp, err := putobject(p, ph, io.TeeReader(lr, h))
+		if err != nil {
+			cleanup()
+			failerror(fmt.Errorf("uploading part %s: %w", p, err))
+		}
+		resp.Body.Close()
+		sum := h.sum()
+		m.Parts = append(m.Parts, manifestpart{name, partsize - lr.N, sum.crc32c, sum.md5})
+		m.Size += partsize - lr.N
+		if s := expectedhash(resp.Header).mismatch(sum); s != "" {
+			cleanup()
+			fail(fmt.Sprintf("part %s: %s", p, s))
+		}
+	}
+
+	buf, err := json.Marshal(m)
+	if err != nil {
+		cleanup()
+		fail(err.Error())
+	}
+	mh := http.Header{}
+	for k, v := range header {
+		mh[k] = v
+	}
+	mh.Set("Content-Type", "application/json")
+	mh.Del(filtersheader)
+	mh.Set("x-goog-hash", datahash(buf).header())
+	resp, err := putobject(dst, mh, bytes.NewReader(buf))
+	if err != nil {
+		cleanup()
+		failerror(fmt.Errorf("uploading manifest: %w", err))
+	}
+	resp.Body.Close()
+}
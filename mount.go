@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"bitbucket.org/mjl/cloudstream/objects"
+)
+
+// Mount files under a prefix as a local file system, with FUSE, for
+// browsing and restoring with the usual tools.  Names are split on
+// slashes into directories.  Files are read with ranged requests, see
+// objects.Reader, as stored: filters are not reversed.  With -rw, new files
+// can be written, sequentially, each streamed to the bucket as a single
+// upload that completes when the file is closed, and files can be
+// removed.  Cloud storage has no directories, those made with mkdir
+// only exist in the mount until they have files.
+
+// Listings of directories are reused for this long.
+const mountlistttl = 10 * time.Second
+
+func mount(args []string) {
+	fs := flag.NewFlagSet("mount", flag.ExitOnError)
+	fs.Usage = usage
+	rw := fs.Bool("rw", false, "allow writing new files and removing files")
+	args = parseflags(fs, args)
+	if len(args) != 2 {
+		usage()
+	}
+	prefix := makepath(args[0])
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	mountpoint := args[1]
+
+	options := []fuse.MountOption{fuse.FSName("cloudstream"), fuse.Subtype("cloudstream")}
+	if !*rw {
+		options = append(options, fuse.ReadOnly())
+	}
+	c, err := fuse.Mount(mountpoint, options...)
+	if err != nil {
+		fail(err.Error())
+	}
+	defer c.Close()
+
+	// Unmount on interrupt, making Serve return, instead of leaving a
+	// mount point behind that can't be accessed.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		if err := fuse.Unmount(mountpoint); err != nil {
+			log.Printf("unmounting %s: %s", mountpoint, err)
+		}
+	}()
+
+	log.Printf("mounted %s on %s", prefix, mountpoint)
+	if err := fusefs.Serve(c, &mountfs{prefix, *rw}); err != nil {
+		fail(err.Error())
+	}
+}
+
+type mountfs struct {
+	prefix string // "/bucket/" or "/bucket/prefix/".
+	rw     bool
+}
+
+func (m *mountfs) Root() (fusefs.Node, error) {
+	return &mountdir{fs: m, path: m.prefix}, nil
+}
+
+// Directory, the objects and common prefixes under path.
+type mountdir struct {
+	fs   *mountfs
+	path string // Ends with a slash.
+
+	sync.Mutex
+	entries map[string]objectinfo // By name within the directory.
+	listed  time.Time
+	made    map[string]bool      // Directories made with mkdir, without files yet.
+	dirs    map[string]*mountdir // Looked up, keeping their listings.
+}
+
+func (d *mountdir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	if d.fs.rw {
+		a.Mode |= 0200
+	}
+	return nil
+}
+
+// Entries of the directory, listed again if older than mountlistttl.
+func (d *mountdir) list() (map[string]objectinfo, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.entries != nil && time.Since(d.listed) < mountlistttl {
+		return d.entries, nil
+	}
+	bucket, prefix := splitpath(d.path)
+	entries := map[string]objectinfo{}
+	err := listobjects(bucket, prefix, "/", "", func(l []objectinfo, marker string) error {
+		for _, o := range l {
+			name := strings.TrimSuffix(strings.TrimPrefix(o.Name, d.path), "/")
+			// Objects named like the directory, created by other tools, are skipped.
+			if name != "" {
+				entries[name] = o
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name := range d.made {
+		if _, ok := entries[name]; !ok {
+			entries[name] = objectinfo{Name: d.path + name + "/", Prefix: true}
+		}
+	}
+	d.entries, d.listed = entries, time.Now()
+	return entries, nil
+}
+
+// Update the entry for name in the listing, added by us.
+func (d *mountdir) update(name string, o objectinfo) {
+	d.Lock()
+	defer d.Unlock()
+	if d.entries != nil {
+		d.entries[name] = o
+	}
+}
+
+func (d *mountdir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	entries, err := d.list()
+	if err != nil {
+		log.Printf("listing %s: %s", d.path, err)
+		return nil, fuse.EIO
+	}
+	var l []fuse.Dirent
+	for name, o := range entries {
+		t := fuse.DT_File
+		if o.Prefix {
+			t = fuse.DT_Dir
+		}
+		l = append(l, fuse.Dirent{Type: t, Name: name})
+	}
+	return l, nil
+}
+
+func (d *mountdir) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	entries, err := d.list()
+	if err != nil {
+		log.Printf("listing %s: %s", d.path, err)
+		return nil, fuse.EIO
+	}
+	o, ok := entries[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	if o.Prefix {
+		return d.subdir(name), nil
+	}
+	return &mountfile{dir: d, name: name, info: o}, nil
+}
+
+func (d *mountdir) subdir(name string) *mountdir {
+	d.Lock()
+	defer d.Unlock()
+	sub := d.dirs[name]
+	if sub == nil {
+		sub = &mountdir{fs: d.fs, path: d.path + name + "/"}
+		if d.dirs == nil {
+			d.dirs = map[string]*mountdir{}
+		}
+		d.dirs[name] = sub
+	}
+	return sub
+}
+
+func (d *mountdir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
+	if !d.fs.rw {
+		return nil, fuse.EPERM
+	}
+	d.Lock()
+	if d.made == nil {
+		d.made = map[string]bool{}
+	}
+	d.made[req.Name] = true
+	d.Unlock()
+	d.update(req.Name, objectinfo{Name: d.path + req.Name + "/", Prefix: true})
+	return d.subdir(req.Name), nil
+}
+
+func (d *mountdir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fusefs.Node, fusefs.Handle, error) {
+	if !d.fs.rw {
+		return nil, nil, fuse.EPERM
+	}
+	f := &mountfile{dir: d, name: req.Name, info: objectinfo{Name: d.path + req.Name, Modified: time.Now()}}
+	d.update(req.Name, f.info)
+	resp.Flags |= fuse.OpenNonSeekable
+	return f, f.writer(), nil
+}
+
+func (d *mountdir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if !d.fs.rw {
+		return fuse.EPERM
+	}
+	if req.Dir {
+		// Only empty directories, i.e. without files, can be removed.
+		sub := d.subdir(req.Name)
+		entries, err := sub.list()
+		if err != nil {
+			log.Printf("listing %s: %s", sub.path, err)
+			return fuse.EIO
+		}
+		if len(entries) > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	} else if err := deleteobject(d.path+req.Name, nil); err != nil && !iserrorstatus(err, 404) {
+		log.Printf("removing %s: %s", d.path+req.Name, err)
+		return fuse.EIO
+	}
+	d.Lock()
+	delete(d.entries, req.Name)
+	delete(d.made, req.Name)
+	delete(d.dirs, req.Name)
+	d.Unlock()
+	return nil
+}
+
+type mountfile struct {
+	dir  *mountdir
+	name string
+
+	sync.Mutex
+	info objectinfo
+}
+
+func (f *mountfile) Attr(ctx context.Context, a *fuse.Attr) error {
+	f.Lock()
+	defer f.Unlock()
+	a.Mode = 0444
+	if f.dir.fs.rw {
+		a.Mode |= 0200
+	}
+	a.Size = uint64(f.info.Size)
+	a.Mtime = f.info.Modified
+	return nil
+}
+
+func (f *mountfile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	if req.Flags.IsReadOnly() {
+		f.Lock()
+		defer f.Unlock()
+		return &mountreader{newobjectreader(f.info.Name, f.info.Size, f.info.ETag)}, nil
+	}
+	// Existing files can only be replaced as a whole.
+	if !f.dir.fs.rw || req.Flags&fuse.OpenTruncate == 0 {
+		return nil, fuse.EPERM
+	}
+	resp.Flags |= fuse.OpenNonSeekable
+	return f.writer(), nil
+}
+
+type mountreader struct {
+	r *objects.Reader
+}
+
+func (h *mountreader) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := h.r.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		log.Printf("reading %s: %s", h.r.Path(), err)
+		return fuse.EIO
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+// Handle for writing a file, streaming the data to an upload.
+type mountwriter struct {
+	f *mountfile
+	w *objects.Writer
+
+	sync.Mutex
+	finished bool
+	err      error
+}
+
+// Start an upload for f.
+func (f *mountfile) writer() *mountwriter {
+	return &mountwriter{f: f, w: newobjectwriter(f.info.Name)}
+}
+
+func (w *mountwriter) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.finished {
+		return fuse.EIO
+	}
+	if req.Offset != w.w.Written() {
+		return fuse.Errno(syscall.ESPIPE)
+	}
+	n, err := w.w.Write(req.Data)
+	resp.Size = n
+	if err != nil {
+		log.Printf("writing %s: %s", w.f.info.Name, err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Complete the upload, on the first close of the file.
+func (w *mountwriter) finish() error {
+	w.Lock()
+	defer w.Unlock()
+	if !w.finished {
+		w.finished = true
+		w.err = w.w.Close()
+		if w.err != nil {
+			log.Printf("uploading %s: %s", w.f.info.Name, w.err)
+		} else {
+			w.f.Lock()
+			w.f.info.Size = w.w.Written()
+			w.f.info.Modified = time.Now()
+			info := w.f.info
+			w.f.Unlock()
+			w.f.dir.update(w.f.name, info)
+		}
+	}
+	if w.err != nil {
+		return fuse.EIO
+	}
+	return nil
+}
+
+func (w *mountwriter) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return w.finish()
+}
+
+func (w *mountwriter) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return w.finish()
+}
@@ -0,0 +1,205 @@
+// Package objects streams objects in cloud storage with the io
+// interfaces, for programs that read and write files like the
+// cloudstream command does: readers with ranged requests for random
+// access, and writers that stream to an upload.
+//
+// Requests are executed by a Backend, which adds the endpoint,
+// authentication and retries.  The cloudstream command has a backend for
+// its configuration file.  Paths are "/bucket/name", unescaped.
+package objects
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Backend executes requests for a Client.
+type Backend interface {
+	// Execute a signed request for path.  Path starts with the bucket,
+	// object names are escaped with EscapePath.  Header may be nil.
+	// The response is returned with any status.
+	Request(ctx context.Context, method, path string, header http.Header, body io.Reader) (*http.Response, error)
+
+	// Store the data from body as the object at path, unescaped.  The
+	// length of the data is not known beforehand.  A response status
+	// other than success is returned as error.
+	Put(ctx context.Context, path string, header http.Header, body io.Reader) error
+}
+
+// Client for reading and writing objects through a Backend.
+type Client struct {
+	Backend Backend
+}
+
+// NewReader returns a reader for the data of the object at path, as
+// stored, with ranged requests, see Reader.  Reads fail once ctx is
+// done, or when the object was replaced.
+func (c *Client) NewReader(ctx context.Context, path string) (io.ReadCloser, error) {
+	r, err := c.NewReaderAt(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &closereader{r: r}, nil
+}
+
+// NewReaderAt returns a Reader for random access to the data of the
+// object at path, an io.ReaderAt and io.ReadSeeker, with its size and
+// etag from a HEAD request.  Reads fail once ctx is done, or when the
+// object was replaced.
+func (c *Client) NewReaderAt(ctx context.Context, path string) (*Reader, error) {
+	h, err := c.head(ctx, path, http.Header{"Accept-Encoding": {"gzip"}})
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad content-length of remote file")
+	}
+	return c.ObjectReader(ctx, path, size, h.Get("ETag")), nil
+}
+
+// NewWriter returns a writer that streams data to an upload to path, see
+// Writer.  Header may be nil, or hold e.g. a Content-Type.  The object is
+// stored by Close.  If ctx is done before Close, the upload is aborted
+// and not stored.
+func (c *Client) NewWriter(ctx context.Context, path string, header http.Header) *Writer {
+	return newwriter(ctx, c.Backend, path, header)
+}
+
+// ObjectUpdate is a change to the metadata of an object, for Update.
+type ObjectUpdate struct {
+	Set          http.Header // Headers to set, e.g. Content-Type or x-goog-meta-*.
+	Remove       []string    // Headers to remove.
+	StorageClass string      // If not empty, the new storage class.
+}
+
+// Update changes the metadata or storage class of the object at path,
+// by copying it onto itself with metadata directive REPLACE.  The data
+// is not transferred.  The update fails if the object is changed
+// concurrently.
+func (c *Client) Update(ctx context.Context, path string, u ObjectUpdate) error {
+	oh, err := c.head(ctx, path, nil)
+	if err != nil {
+		return err
+	}
+	h := ObjectHeaders(oh)
+	for _, k := range u.Remove {
+		h.Del(k)
+	}
+	for k, v := range u.Set {
+		h[http.CanonicalHeaderKey(k)] = v
+	}
+	if u.StorageClass != "" {
+		h.Set("x-goog-storage-class", u.StorageClass)
+	}
+	h.Set("x-goog-copy-source", EscapePath(path))
+	h.Set("x-goog-metadata-directive", "REPLACE")
+	// Fail instead of overwriting a newer version written in the meantime.
+	if g := oh.Get("x-goog-generation"); g != "" {
+		h.Set("x-goog-if-generation-match", g)
+	}
+	resp, err := c.Backend.Request(ctx, "PUT", EscapePath(path), h, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return ResponseError(resp)
+	}
+	return nil
+}
+
+// Headers of the object at path, with a HEAD request.
+func (c *Client) head(ctx context.Context, path string, header http.Header) (http.Header, error) {
+	resp, err := c.Backend.Request(ctx, "HEAD", EscapePath(path), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &StatusError{resp.StatusCode, fmt.Sprintf("status: %s", resp.Status)}
+	}
+	return resp.Header, nil
+}
+
+// ObjectHeaders returns the headers of a HEAD or GET response that
+// describe the object, for setting them again when copying with metadata
+// directive REPLACE.
+func ObjectHeaders(h http.Header) http.Header {
+	r := http.Header{}
+	for k, v := range h {
+		switch lk := strings.ToLower(k); {
+		case strings.HasPrefix(lk, "x-goog-meta-"),
+			lk == "content-type",
+			lk == "content-encoding",
+			lk == "content-disposition",
+			lk == "content-language",
+			lk == "cache-control",
+			lk == "x-goog-storage-class":
+			r[k] = v
+		}
+	}
+	return r
+}
+
+// EscapePath percent-encodes path for use in a request url, and in the
+// string to sign, which must match what is sent.  Only unreserved
+// characters and slashes are left as is, so names with e.g. spaces, "+",
+// "?" or non-ascii characters work.
+func EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// StatusError is an error for an unexpected response status.
+type StatusError struct {
+	Code int
+	Msg  string
+}
+
+func (e *StatusError) Error() string {
+	return e.Msg
+}
+
+// ResponseError returns a StatusError for an unexpected response, with
+// the start of its body for details.
+func ResponseError(resp *http.Response) error {
+	buf, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	msg := strings.TrimSpace(string(buf))
+	if msg == "" {
+		return &StatusError{resp.StatusCode, fmt.Sprintf("status: %s", resp.Status)}
+	}
+	return &StatusError{resp.StatusCode, fmt.Sprintf("status: %s: %s", resp.Status, msg)}
+}
+
+// Reader of NewReader, without random access.
+type closereader struct {
+	r      *Reader
+	closed bool
+}
+
+func (r *closereader) Read(buf []byte) (int, error) {
+	if r.closed {
+		return 0, errors.New("reader closed")
+	}
+	return r.r.Read(buf)
+}
+
+func (r *closereader) Close() error {
+	r.closed = true
+	return nil
+}
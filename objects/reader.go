@@ -0,0 +1,157 @@
+package objects
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Reader gives random access to the data of an object, with ranged
+// requests, for reading files like zip archives or databases without
+// fetching all data.  Reads are rounded up to the readahead size, and the
+// last block is kept, so small sequential reads don't each make a
+// request.  The data is returned as stored: filters and a
+// Content-Encoding are not reversed.
+type Reader struct {
+	ctx     context.Context
+	backend Backend
+	path    string
+	size    int64
+	etag    string // Requests fail when the object was replaced.
+
+	offset int64 // For Read and Seek.
+
+	sync.Mutex
+	cache       []byte
+	cacheoffset int64
+}
+
+// Data fetched with a request, at least.
+const readahead = 1024 * 1024
+
+// ObjectReader returns a reader for the object at path of size, e.g. as
+// listed, without a request.  If etag is empty, reads don't fail when the
+// object is replaced.  Reads fail once ctx is done.
+func (c *Client) ObjectReader(ctx context.Context, path string, size int64, etag string) *Reader {
+	return &Reader{ctx: ctx, backend: c.Backend, path: path, size: size, etag: etag}
+}
+
+// Path returns the path of the object.
+func (r *Reader) Path() string {
+	return r.path
+}
+
+// Size returns the size of the object.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// ReadAt is safe to call concurrently.
+func (r *Reader) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(buf) {
+		o := offset + int64(n)
+		if o >= r.size {
+			return n, io.EOF
+		}
+		data, err := r.block(o, int64(len(buf)-n))
+		if err != nil {
+			return n, err
+		}
+		n += copy(buf[n:], data)
+	}
+	return n, nil
+}
+
+// Data at offset, from the cache, or fetched with at least need bytes,
+// or up to the end of the object.
+func (r *Reader) block(offset, need int64) ([]byte, error) {
+	r.Lock()
+	if offset >= r.cacheoffset && offset < r.cacheoffset+int64(len(r.cache)) {
+		data := r.cache[offset-r.cacheoffset:]
+		r.Unlock()
+		return data, nil
+	}
+	r.Unlock()
+
+	n := need
+	if n < readahead {
+		n = readahead
+	}
+	if offset+n > r.size {
+		n = r.size - offset
+	}
+	data, err := r.fetch(offset, n)
+	if err != nil {
+		var se *StatusError
+		if errors.As(err, &se) && se.Code == http.StatusPreconditionFailed {
+			err = fmt.Errorf("%s: file changed while reading", r.path)
+		}
+		return nil, err
+	}
+	r.Lock()
+	r.cache, r.cacheoffset = data, offset
+	r.Unlock()
+	return data, nil
+}
+
+// Fetch n bytes at offset with a ranged request, of the stored data:
+// with Accept-Encoding, a Content-Encoding of gzip isn't reversed by the
+// server.
+func (r *Reader) fetch(offset, n int64) ([]byte, error) {
+	if err := r.ctx.Err(); err != nil {
+		return nil, err
+	}
+	header := http.Header{
+		"Range":           {fmt.Sprintf("bytes=%d-%d", offset, offset+n-1)},
+		"Accept-Encoding": {"gzip"},
+	}
+	if r.etag != "" {
+		header.Set("If-Match", r.etag)
+	}
+	resp, err := r.backend.Request(r.ctx, "GET", EscapePath(r.path), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 206 && resp.StatusCode != 200 {
+		return nil, ResponseError(resp)
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, n+1))
+	if err == nil && int64(len(buf)) != n {
+		err = fmt.Errorf("read %d bytes, expected %d", len(buf), n)
+	}
+	return buf, err
+}
+
+func (r *Reader) Read(buf []byte) (int, error) {
+	n, err := r.ReadAt(buf, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.offset, errors.New("bad whence")
+	}
+	if offset < 0 {
+		return r.offset, errors.New("negative offset")
+	}
+	r.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,97 @@
+package objects
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Writer streams data to an upload of an object, for programs that get
+// data in writes instead of from a reader, like a file system.  The
+// object is stored by Close, when all data was written.  Close without
+// writing stores an empty object.
+type Writer struct {
+	ctx  context.Context
+	pw   *io.PipeWriter
+	done chan error // Result of the upload.
+	n    int64      // Bytes written.
+
+	sync.Mutex
+	finished bool // Closed or aborted.
+	err      error
+}
+
+func newwriter(ctx context.Context, backend Backend, path string, header http.Header) *Writer {
+	pr, pw := io.Pipe()
+	w := &Writer{ctx: ctx, pw: pw, done: make(chan error, 1)}
+	if header == nil {
+		header = http.Header{}
+	}
+	go func() {
+		err := backend.Put(ctx, path, header, pr)
+		// Writes after a failed upload return its error.
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w
+}
+
+// Written returns the number of bytes written.
+func (w *Writer) Written() int64 {
+	return w.n
+}
+
+func (w *Writer) Write(buf []byte) (int, error) {
+	if err := w.result(); err != nil {
+		return 0, err
+	}
+	if err := w.ctx.Err(); err != nil {
+		w.Abort(err)
+		return 0, err
+	}
+	n, err := w.pw.Write(buf)
+	w.n += int64(n)
+	return n, err
+}
+
+// Close completes the upload, returning its error.
+func (w *Writer) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		w.Abort(err)
+	}
+	w.Lock()
+	defer w.Unlock()
+	if !w.finished {
+		w.finished = true
+		w.pw.Close()
+		w.err = <-w.done
+	}
+	return w.err
+}
+
+// Abort aborts the upload with err, the object is not stored.
+func (w *Writer) Abort(err error) {
+	w.Lock()
+	defer w.Unlock()
+	if !w.finished {
+		w.finished = true
+		w.pw.CloseWithError(err)
+		<-w.done
+		w.err = err
+	}
+}
+
+// Error for a write after Close or Abort.
+func (w *Writer) result() error {
+	w.Lock()
+	defer w.Unlock()
+	if !w.finished {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return errors.New("writer closed")
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Flag -on-error, for commands working on many files: "continue" with
+// the other files, "fail" to stop starting new work, or "retry-later" to
+// continue, and queue the failed files in the state file of the command
+// for the next run.
+func onerrorflag(fs *flag.FlagSet) *string {
+	return fs.String("on-error", "continue", "when a file fails: continue, fail to stop starting on other files, or retry-later to queue it in the state file for the next run")
+}
+
+func checkonerror(mode, statefile string) {
+	switch mode {
+	case "continue", "fail":
+	case "retry-later":
+		if statefile == "" {
+			fail("-on-error retry-later needs a -state file")
+		}
+	default:
+		fail(fmt.Sprintf("unknown -on-error %q, must be continue, fail or retry-later", mode))
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Reader for data of known size that is fetched in parts, with multiple
+// parts in flight.  Data is returned in order.  At most concurrency
+// parts are buffered in memory.
+type parallelreader struct {
+	parts chan chan partresult // Parts in order, each to be completed by a fetcher.
+	done  chan struct{}        // Closed by Close, to stop fetching.
+	buf   []byte               // Remaining data of the current part.
+	err   error
+}
+
+type partresult struct {
+	buf []byte
+	err error
+}
+
+// Fetch reads the part of n bytes starting at offset.
+func newparallelreader(size, partsize int64, concurrency int, fetch func(offset, n int64) ([]byte, error)) *parallelreader {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	r := &parallelreader{
+		parts: make(chan chan partresult, concurrency-1),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(r.parts)
+		for offset := int64(0); offset < size; offset += partsize {
+			n := partsize
+			if offset+n > size {
+				n = size - offset
+			}
+			c := make(chan partresult, 1)
+			select {
+			case r.parts <- c:
+			case <-r.done:
+				return
+			}
+			go func(offset, n int64) {
+				buf, err := fetch(offset, n)
+				if err == nil && int64(len(buf)) != n {
+					err = io.ErrUnexpectedEOF
+				}
+				c <- partresult{buf, err}
+			}(offset, n)
+		}
+	}()
+	return r
+}
+
+func (r *parallelreader) Read(buf []byte) (int, error) {
+	for len(r.buf) == 0 && r.err == nil {
+		c, ok := <-r.parts
+		if !ok {
+			r.err = io.EOF
+			break
+		}
+		pr := <-c
+		r.buf, r.err = pr.buf, pr.err
+	}
+	if len(r.buf) == 0 {
+		return 0, r.err
+	}
+	n := copy(buf, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *parallelreader) Close() error {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	if r.err == nil {
+		r.err = errors.New("reader closed")
+	}
+	return nil
+}
+
+// Read src in parts of partsize bytes, starting with the already read
+// first part, and call upload for each, numbered from 1, with
+// concurrency calls at a time.  At most concurrency+1 parts are in
+// memory.  After the first failure, no more parts are read, and that
+// error is returned.
+func uploadparts(src io.Reader, first []byte, partsize int64, concurrency int, upload func(number int, buf []byte) error) error {
+	type part struct {
+		number int
+		buf    []byte
+	}
+	parts := make(chan part)
+	done := make(chan struct{}) // Closed on the first failure, to stop reading.
+	var mutex sync.Mutex
+	var failure error
+	failed := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failure == nil {
+			failure = err
+			close(done)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range parts {
+				if err := upload(p.number, p.buf); err != nil {
+					failed(fmt.Errorf("part %d: %s", p.number, err))
+				}
+			}
+		}()
+	}
+
+	stopped := func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+	buf, last := first, false
+	for number := 1; ; number++ {
+		select {
+		case parts <- part{number, buf}:
+		case <-done:
+		}
+		if last || stopped() {
+			break
+		}
+		buf = make([]byte, partsize)
+		n, err := io.ReadFull(src, buf)
+		if err == io.EOF {
+			// The previous part was the last.
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			last = true
+		} else if err != nil {
+			failed(err)
+			break
+		}
+		buf = buf[:n]
+	}
+	close(parts)
+	wg.Wait()
+	return failure
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Signed urls, with the signature in the query string instead of the
+// Authorization header.  Anyone with the url can make the request until
+// it expires, without credentials.  Urls are signed with the HMAC key, in
+// the configured signature version, or with the private key of the
+// service account.
+
+// Signature version 4 urls are valid for at most 7 days.
+const maxv4expires = 7 * 24 * time.Hour
+
+func presign(args []string) {
+	fs := flag.NewFlagSet("presign", flag.ExitOnError)
+	fs.Usage = usage
+	expires := fs.Duration("expires", time.Hour, "time the url is valid")
+	method := fs.String("method", "GET", "GET for downloading, PUT for uploading")
+	contenttype := fs.String("content-type", "", "content-type the upload with a PUT url must have")
+	args = parseflags(fs, args)
+	if len(args) != 1 || *expires <= 0 {
+		usage()
+	}
+	m := strings.ToUpper(*method)
+	if m != "GET" && m != "PUT" {
+		fail("-method must be GET or PUT")
+	}
+	if *contenttype != "" && m != "PUT" {
+		fail("-content-type is only for PUT urls")
+	}
+	u, err := presignurl(m, makepath(args[0]), *contenttype, *expires, time.Now().Add(clockoffset))
+	if err != nil {
+		fail(err.Error())
+	}
+	fmt.Println(u)
+}
+
+// Signed url for method on path, valid for expires from t.  If
+// contenttype is set, the request must have that Content-Type.
+func presignurl(method, path, contenttype string, expires time.Duration, t time.Time) (string, error) {
+	if usebearer() {
+		if config.ServiceAccount == "" {
+			return "", fmt.Errorf("signing urls needs an hmac key or a service account key")
+		}
+		k, err := readserviceaccount(config.ServiceAccount)
+		if err != nil {
+			return "", err
+		}
+		exp := fmt.Sprintf("%d", t.Add(expires).Unix())
+		msg := method + "\n\n" + contenttype + "\n" + exp + "\n" + canonicalresource(path)
+		sig, err := k.sign(msg)
+		if err != nil {
+			return "", err
+		}
+		q := url.Values{"GoogleAccessId": {k.ClientEmail}, "Expires": {exp}, "Signature": {base64.StdEncoding.EncodeToString(sig)}}
+		return requesturl(escapepath(path)) + "?" + q.Encode(), nil
+	}
+	if usev4() {
+		return presignv4(method, path, contenttype, expires, t)
+	}
+
+	exp := fmt.Sprintf("%d", t.Add(expires).Unix())
+	msg := method + "\n\n" + contenttype + "\n" + exp + "\n" + canonicalresource(path)
+	h := hmac.New(sha1.New, []byte(config.Secret))
+	h.Write([]byte(msg))
+	idparam := "AWSAccessKeyId"
+	if googlestorage() {
+		idparam = "GoogleAccessId"
+	}
+	q := url.Values{idparam: {config.AccessKey}, "Expires": {exp}, "Signature": {base64.StdEncoding.EncodeToString(h.Sum(nil))}}
+	return requesturl(escapepath(path)) + "?" + q.Encode(), nil
+}
+
+// Signed url with signature version 4.  Only the host and content-type
+// headers are signed, the payload is not.
+func presignv4(method, path, contenttype string, expires time.Duration, t time.Time) (string, error) {
+	if expires > maxv4expires {
+		return "", fmt.Errorf("urls with signature version 4 expire within 7 days")
+	}
+	t = t.UTC()
+	u, err := url.Parse(requesturl(escapepath(path)))
+	if err != nil {
+		return "", err
+	}
+	scope := t.Format("20060102") + "/" + region() + "/s3/aws4_request"
+	headers, signed := "host:"+u.Host+"\n", "host"
+	if contenttype != "" {
+		headers, signed = "content-type:"+contenttype+"\n"+headers, "content-type;host"
+	}
+	q := url.Values{
+		"X-Amz-Algorithm":     {v4algorithm},
+		"X-Amz-Credential":    {config.AccessKey + "/" + scope},
+		"X-Amz-Date":          {t.Format(v4amzdateformat)},
+		"X-Amz-Expires":       {fmt.Sprintf("%d", int64(expires/time.Second))},
+		"X-Amz-SignedHeaders": {signed},
+	}
+	query := v4canonicalquery(q.Encode())
+	canonical := strings.Join([]string{
+		method,
+		v4canonicaluri(u.Path),
+		query,
+		headers,
+		signed,
+		v4unsigned,
+	}, "\n")
+	h := sha256.Sum256([]byte(canonical))
+	msg := v4algorithm + "\n" + t.Format(v4amzdateformat) + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+	sig := hex.EncodeToString(hmacsha256(v4signingkey(t), msg))
+	u.RawQuery = query + "&X-Amz-Signature=" + sig
+	return u.String(), nil
+}
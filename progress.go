@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Progress of a transfer, printed to stderr: bytes transferred,
+// throughput, and if the size is known, the percentage and estimated
+// time remaining.  On a terminal, a single line is updated every second,
+// otherwise a line is printed every 30 seconds.
+type progress struct {
+	total int64 // -1 if unknown.
+	n     int64 // Atomic.
+	start time.Time
+	tty   bool
+	done  chan struct{}
+	ended chan struct{}
+}
+
+func newprogress(total int64) *progress {
+	p := &progress{
+		total: total,
+		start: time.Now(),
+		tty:   term.IsTerminal(int(os.Stderr.Fd())),
+		done:  make(chan struct{}),
+		ended: make(chan struct{}),
+	}
+	interval := 30 * time.Second
+	if p.tty {
+		interval = time.Second
+	}
+	go func() {
+		defer close(p.ended)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.print(false)
+			case <-p.done:
+				p.print(true)
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Reader counting the data read from r.
+func (p *progress) reader(r io.Reader) io.Reader {
+	return &progressreader{r, p}
+}
+
+type progressreader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressreader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	atomic.AddInt64(&r.p.n, int64(n))
+	return n, err
+}
+
+// Print the final state.
+func (p *progress) finish() {
+	close(p.done)
+	<-p.ended
+}
+
+func (p *progress) print(final bool) {
+	n := atomic.LoadInt64(&p.n)
+	elapsed := time.Since(p.start)
+	rate := float64(n) / elapsed.Seconds()
+	s := fmt.Sprintf("%s, %s/s", formatsize(n), formatsize(int64(rate)))
+	if p.total > 0 {
+		s = fmt.Sprintf("%s of %s (%d%%), %s/s", formatsize(n), formatsize(p.total), n*100/p.total, formatsize(int64(rate)))
+		if !final && rate > 0 && n < p.total {
+			eta := time.Duration(float64(p.total-n)/rate) * time.Second
+			s += fmt.Sprintf(", %s left", eta.Round(time.Second))
+		}
+	}
+	if final {
+		s += fmt.Sprintf(", %s", elapsed.Round(time.Second))
+	}
+	if p.tty {
+		end := ""
+		if final {
+			end = "\n"
+		}
+		fmt.Fprintf(os.Stderr, "\r\x1b[K%s%s", s, end)
+	} else {
+		fmt.Fprintln(os.Stderr, s)
+	}
+}
+
+// Size with a binary unit, e.g. "1.5M".
+func formatsize(n int64) string {
+	units := "kMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f := float64(n)
+	i := -1
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", f, units[i])
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func put(args []string) {
+	fs := flag.NewFlagSet("put", flag.ExitOnError)
+	fs.Usage = usage
+	ifnotexists := fs.Bool("if-not-exists", false, "only create the file, fail if it already exists")
+	ifgenerationmatch := fs.Int64("if-generation-match", -1, "only replace the file if it is at this generation, e.g. as seen before, 0 for only if it does not exist")
+	expectsize := size(-1)
+	fs.Var(&expectsize, "expect-size", "size of the data, the upload is aborted or the file removed on mismatch")
+	maxduration := fs.Duration("max-duration", 0, "stop the upload after duration, printing how to continue")
+	resume := fs.String("resume", "", "continue the resumable upload session at url")
+	resumable := fs.Bool("resumable", false, "upload with the resumable upload protocol, continuing after network errors")
+	fromurl := fs.String("from-url", "", "upload the data at http(s) url instead of stdin")
+	concurrency := fs.Int("concurrency", 1, "number of concurrent ranged requests to the -from-url source, or files with -r")
+	keys := keyflags(fs, "")
+	fs.Var(&keys.recipients, "encrypt-to", "encrypt with age to recipient, an age1... public key or file with keys, can be repeated")
+	ciphername := fs.String("cipher", "aes-256-gcm", "cipher for encryption, aes-256-gcm or xchacha20-poly1305")
+	filterspec := fs.String("filters", config.Filters, "filter pipeline, e.g. gzip,encrypt")
+	filterput := fs.String("filter-put", "", "shell command to pass the data through before the other filters, e.g. \"zstd -19\"")
+	compress := fs.String("compress", "", "compress with gzip[:level] or zstd[:level], before the other filters")
+	contenttype := fs.String("content-type", "", "content-type of the file, by default detected from the name or the start of the data")
+	var meta multiflag
+	fs.Var(&meta, "meta", "custom metadata key=value, can be repeated")
+	customtime := fs.String("custom-time", "", "custom time of the file, for lifecycle rules, in RFC3339 format")
+	temporaryhold := fs.Bool("temporary-hold", false, "place a temporary hold on the file after uploading")
+	partsize := size(config.PartSize)
+	fs.Var(&partsize, "part-size", "size of parts for -composite, and multipart uploads to s3 endpoints, at least 5M")
+	partconcurrency := fs.Int("part-concurrency", config.PartConcurrency, "number of parts uploaded at a time, for -composite, and multipart uploads to s3 endpoints")
+	composite := fs.Bool("composite", false, "upload parts of the data concurrently as temporary files, and compose them into the file")
+	split := size(0)
+	fs.Var(&split, "split", "store the data in numbered files of this size, path.000 etc., and a manifest at path, for get -joined")
+	appendmode := fs.Bool("append", false, "append the data to the file, composing it onto the existing file")
+	appendinterval := fs.Duration("append-interval", 10*time.Second, "with -append, append data read so far at least every interval, 0 for only at the end or every part size")
+	tee := fs.Bool("tee", false, "also write the data to stdout, as read, e.g. to use put in a pipeline")
+	gzipencoding := fs.Bool("gzip", false, "compress with gzip, stored with Content-Encoding gzip, decompressed by get and other clients")
+	showprogress := fs.Bool("progress", false, "print progress of the upload to stderr")
+	public := fs.Bool("public", false, "make the file readable by anyone, with the public-read acl")
+	recursive := fs.Bool("r", false, "upload the files in a local directory, to names with their relative path under a prefix")
+	csek, _ := csekflags(fs, false)
+	kmskey := fs.String("kms-key", config.KMSKey, "name of the cloud kms key to encrypt the file with, instead of the default key")
+	onerror := onerrorflag(fs)
+	args = parseflags(fs, args)
+	if !*recursive && len(args) != 1 || *recursive && len(args) != 2 {
+		usage()
+	}
+	if *csek != "" && *kmskey != "" {
+		fail("-csek-key cannot be combined with -kms-key, or a kmskey in the configuration file")
+	}
+	setcsek(*csek)
+	if *recursive && (expectsize >= 0 || *maxduration > 0 || *resume != "" || *resumable || *fromurl != "" || *temporaryhold) {
+		fail("-r cannot be combined with -expect-size, -max-duration, -resume, -resumable, -from-url or -temporary-hold")
+	}
+	if *composite && (*maxduration > 0 || *resume != "" || *resumable || *recursive) {
+		fail("-composite cannot be combined with -max-duration, -resume, -resumable or -r")
+	}
+	if split > 0 && (*composite || *maxduration > 0 || *resume != "" || *resumable || *recursive || expectsize >= 0 || *temporaryhold || *gzipencoding) {
+		fail("-split cannot be combined with -composite, -max-duration, -resume, -resumable, -r, -expect-size, -temporary-hold or -gzip")
+	}
+	if *appendmode && (*ifnotexists || *ifgenerationmatch >= 0 || expectsize >= 0 || *maxduration > 0 || *resume != "" || *resumable || *composite || split > 0 || *recursive) {
+		fail("-append cannot be combined with -if-not-exists, -if-generation-match, -expect-size, -max-duration, -resume, -resumable, -composite, -split or -r")
+	}
+	if *tee && (*maxduration > 0 || *resume != "" || *resumable || *recursive) {
+		// Data sent again after an error would be written to stdout again.
+		fail("-tee cannot be combined with -max-duration, -resume, -resumable or -r")
+	}
+	if *appendmode && !googlestorage() {
+		fail("-append needs google cloud storage")
+	}
+	if *composite && !googlestorage() {
+		fail("-composite needs google cloud storage, uploads to s3 endpoints are always multipart uploads")
+	}
+	if *onerror == "retry-later" {
+		fail("-on-error retry-later needs a state file, see sync")
+	}
+	checkonerror(*onerror, "")
+	if partsize != 0 && partsize < minpartsize {
+		fail("-part-size must be at least 5M")
+	}
+	config.PartSize = int64(partsize)
+	config.PartConcurrency = *partconcurrency
+
+	spec, filters := putfilters(*filterspec, *compress, *ciphername, keys)
+	if *gzipencoding && len(filters) > 0 {
+		fail("-gzip cannot be combined with filters, use the gzip filter instead")
+	}
+	if *gzipencoding {
+		// Like the gzip filter, but stored with a Content-Encoding header,
+		// which other clients know to decompress, instead of the filters
+		// header.
+		filters = []filter{gzipfilter{gzip.DefaultCompression}}
+	}
+	if *filterput != "" {
+		filters = append([]filter{execfilter{put: *filterput}}, filters...)
+	}
+	if len(filters) > 0 && *appendmode {
+		fail("-append cannot be combined with filters, -gzip or -filter-put, the data would not be decoded as a whole")
+	}
+	if len(filters) > 0 && (*maxduration > 0 || *resume != "") {
+		fail("filtered uploads cannot be resumed, filters, -gzip and -filter-put cannot be combined with -max-duration or -resume")
+	}
+
+	header := http.Header{}
+	if *ifnotexists && *ifgenerationmatch >= 0 {
+		fail("-if-not-exists cannot be combined with -if-generation-match")
+	}
+	if *ifnotexists {
+		// Generation 0 matches only if there is no live version of the object.
+		header.Set("x-goog-if-generation-match", "0")
+	} else if *ifgenerationmatch >= 0 {
+		header.Set("x-goog-if-generation-match", fmt.Sprintf("%d", *ifgenerationmatch))
+	}
+	if *customtime != "" {
+		if err := customtimeheader(header, *customtime); err != nil {
+			fail(err.Error())
+		}
+	}
+	for _, kv := range meta {
+		if strings.HasPrefix(strings.ToLower(kv), "cloudstream-") {
+			fail(fmt.Sprintf("metadata %q: keys starting with cloudstream- are reserved", kv))
+		}
+		if err := metaheader(header, kv); err != nil {
+			fail(err.Error())
+		}
+	}
+	if *gzipencoding {
+		header.Set("Content-Encoding", "gzip")
+	}
+	if *kmskey != "" {
+		header.Set("x-goog-encryption-kms-key-name", *kmskey)
+	}
+	if *public {
+		header.Set("x-goog-acl", "public-read")
+	}
+	// The type is detected only for data stored as is, or with a gzip
+	// Content-Encoding, not for the output of filters.
+	detect := spec == "" && *filterput == ""
+	if *contenttype != "" {
+		header.Set("Content-Type", *contenttype)
+		detect = false
+	}
+
+	if *recursive {
+		// Ask for a passphrase once, before uploads start concurrently.
+		if keys.usepassphrase() {
+			if _, err := keys.passphrase(true); err != nil {
+				fail(err.Error())
+			}
+		}
+		prefix := makepath(args[1])
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		putrecursive(args[0], prefix, header, filters, spec, detect, *concurrency, *onerror)
+		return
+	}
+	path := makepath(args[0])
+	if detect {
+		// A stream is sniffed when it is read, below, except for resumable
+		// uploads, which need the type when starting.
+		if fi, err := os.Stdin.Stat(); *fromurl == "" && err == nil && fi.Mode().IsRegular() {
+			t, err := filecontenttype(path, os.Stdin)
+			if err != nil {
+				fail(err.Error())
+			}
+			header.Set("Content-Type", t)
+		} else if t := extensiontype(path); t != "" {
+			header.Set("Content-Type", t)
+		}
+	}
+
+	open := stdinsource
+	if *fromurl != "" {
+		open = urlsource(*fromurl, *concurrency)
+	}
+	if expectsize >= 0 {
+		open = checksize(open, int64(expectsize))
+	}
+	if *tee {
+		discardresponse = true
+		base := open
+		open = func(offset int64) (io.Reader, error) {
+			r, err := base(offset)
+			if err != nil {
+				return nil, err
+			}
+			return io.TeeReader(r, os.Stdout), nil
+		}
+	}
+	var p *progress
+	if *showprogress {
+		total := int64(expectsize)
+		if fi, err := os.Stdin.Stat(); total < 0 && *fromurl == "" && err == nil && fi.Mode().IsRegular() {
+			total = fi.Size()
+		}
+		p = newprogress(total)
+		base := open
+		open = func(offset int64) (io.Reader, error) {
+			r, err := base(offset)
+			if err != nil {
+				return nil, err
+			}
+			atomic.StoreInt64(&p.n, offset)
+			return p.reader(r), nil
+		}
+	}
+
+	if len(filters) > 0 && *resumable {
+		// Within a run, chunks are sent again from memory, the filtered stream
+		// does not have to be reproduced.
+		src, err := open(0)
+		if err != nil {
+			fail(err.Error())
+		}
+		if spec != "" {
+			header.Set(filtersheader, spec)
+		}
+		src, err = encodefilters(filters, src, header)
+		if err != nil {
+			fail(err.Error())
+		}
+		putresumable(path, header, func(offset int64) (io.Reader, error) { return src, nil }, 0, "", nil)
+	} else if *maxduration > 0 || *resume != "" || *resumable {
+		continuecmd := func(u *upload) string {
+			if *fromurl != "" {
+				return fmt.Sprintf("cloudstream put -resume '%s' -from-url '%s' %s", u.url, *fromurl, path)
+			}
+			return fmt.Sprintf("cloudstream put -resume '%s' %s  # with stdin from offset %d", u.url, path, u.offset)
+		}
+		putresumable(path, header, open, *maxduration, *resume, continuecmd)
+	} else {
+		// With a file as stdin, the hashes can be sent along, for the server
+		// to check.  Streams are checked for composite uploads, and on the
+		// S3-compatible servers, by part.
+		if fi, err := os.Stdin.Stat(); *fromurl == "" && len(filters) == 0 && err == nil && fi.Mode().IsRegular() {
+			gh, err := filehash(os.Stdin)
+			if err != nil {
+				fail(err.Error())
+			}
+			header.Set("x-goog-hash", gh.header())
+		}
+		src, err := open(0)
+		if err != nil {
+			fail(err.Error())
+		}
+		if detect && header.Get("Content-Type") == "" {
+			var t string
+			t, src, err = detectcontenttype(path, src)
+			if err != nil {
+				fail(err.Error())
+			}
+			header.Set("Content-Type", t)
+		}
+		if len(filters) > 0 {
+			if spec != "" {
+				header.Set(filtersheader, spec)
+			}
+			src, err = encodefilters(filters, src, header)
+			if err != nil {
+				fail(err.Error())
+			}
+		}
+		if *appendmode {
+			putappend(path, header, src, *appendinterval, multipartsize())
+		} else if split > 0 {
+			putsplit(path, header, src, int64(split), spec)
+		} else if *composite {
+			resp, err := compositeput(path, header, src, multipartsize(), multipartconcurrency())
+			if err != nil {
+				failerror(err)
+			}
+			writeresponse(resp)
+		} else {
+			putstream(path, header, src)
+		}
+	}
+
+	if p != nil {
+		p.finish()
+	}
+
+	// The stored size is only known for unfiltered data.
+	if expectsize >= 0 && len(filters) == 0 {
+		h, err := head(path)
+		if err != nil {
+			fail("checking size: " + err.Error())
+		}
+		stored, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		if err != nil {
+			fail("checking size: bad content-length of remote file")
+		}
+		if stored != int64(expectsize) {
+			// Only the file just stored is removed, not one stored after it.
+			var dh http.Header
+			if g := h.Get("x-goog-generation"); g != "" {
+				dh = http.Header{"x-goog-if-generation-match": {g}}
+			}
+			if err := deleteobject(path, dh); err != nil {
+				fail(fmt.Sprintf("stored file has size %d, expected %d, removing: %s", stored, expectsize, err))
+			}
+			fail(fmt.Sprintf("stored file has size %d, expected %d, removed", stored, expectsize))
+		}
+	}
+
+	if *temporaryhold {
+		if err := settemporaryhold(path, true); err != nil {
+			fail("placing temporary hold: " + err.Error())
+		}
+	}
+}
+
+// Filter pipeline for uploads, from -filters, extended with encryption if
+// a key or recipients are set without filters, and with -compress.
+func putfilters(filterspec, compress, ciphername string, keys *keyopts) (string, []filter) {
+	spec := strings.Replace(filterspec, " ", "", -1)
+	if spec == "" && keys.enabled() {
+		spec = "encrypt:" + ciphername
+	} else if spec == "" && len(keys.recipients) > 0 {
+		spec = "age"
+	}
+	if compress != "" {
+		if name := strings.SplitN(compress, ":", 2)[0]; name != "gzip" && name != "zstd" {
+			fail("-compress must be gzip or zstd, with an optional level")
+		}
+		spec = strings.TrimSuffix(compress+","+spec, ",")
+	}
+	filters, err := parsefilters(spec, keys)
+	if err != nil {
+		fail(err.Error())
+	}
+	if keys.enabled() && !strings.Contains(","+spec, ",encrypt") {
+		fail("encryption key specified, but filters do not include encrypt")
+	}
+	if len(keys.recipients) > 0 && !strings.Contains(","+spec, ",age") {
+		fail("age recipients specified, but filters do not include age")
+	}
+	return spec, filters
+}
+
+// Source of the data to upload, returning the data starting at offset.
+type source func(offset int64) (io.Reader, error)
+
+// Read from stdin.  If stdin is a file, it is positioned at offset,
+// otherwise stdin must start at offset.
+func stdinsource(offset int64) (io.Reader, error) {
+	if offset > 0 {
+		if fi, err := os.Stdin.Stat(); err == nil && fi.Mode().IsRegular() {
+			if _, err := os.Stdin.Seek(offset, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return os.Stdin, nil
+}
+
+// Read from an http(s) url.  If concurrency > 1 and the server supports
+// ranged requests, parts of the data are fetched concurrently.
+func urlsource(url string, concurrency int) source {
+	return func(offset int64) (io.Reader, error) {
+		if concurrency > 1 {
+			resp, err := client.Head(url)
+			if err != nil {
+				return nil, err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				return nil, fmt.Errorf("%s: %s", url, resp.Status)
+			}
+			if resp.Header.Get("Accept-Ranges") == "bytes" && resp.ContentLength >= 0 {
+				fetch := func(o, n int64) ([]byte, error) {
+					return fetchrange(url, offset+o, n)
+				}
+				return newparallelreader(resp.ContentLength-offset, chunksize, concurrency, fetch), nil
+			}
+		}
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		status := 200
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			status = 206
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != status {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: %s", url, resp.Status)
+		}
+		return resp.Body, nil
+	}
+}
+
+// Source that fails when reading fewer or more than size bytes in total.
+func checksize(open source, size int64) source {
+	return func(offset int64) (io.Reader, error) {
+		r, err := open(offset)
+		if err != nil {
+			return nil, err
+		}
+		// Read one byte more than expected, to notice too long input.
+		return &sizereader{io.LimitReader(r, size-offset+1), offset, size}, nil
+	}
+}
+
+type sizereader struct {
+	r    io.Reader
+	n    int64
+	size int64
+}
+
+func (r *sizereader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	r.n += int64(n)
+	if r.n > r.size {
+		return n, fmt.Errorf("read more than expected %d bytes, aborting upload", r.size)
+	}
+	if err == io.EOF && r.n != r.size {
+		return n, fmt.Errorf("read %d bytes, expected %d, aborting upload", r.n, r.size)
+	}
+	return n, err
+}
+
+// Fetch n bytes at offset from url with a ranged request.
+func fetchrange(url string, offset, n int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+n-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 206 {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Upload src in a single request, with chunked transfer-encoding.
+func putstream(path string, header http.Header, src io.Reader) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(pw, src)
+		if err != nil {
+			// The upload has not been completed, the file will not be created.
+			pw.CloseWithError(err)
+			return
+		}
+		err = pw.Close()
+		if err != nil {
+			fail(err.Error())
+		}
+	}()
+
+	resp, err := putobject(path, header, pr)
+	if err != nil {
+		failerror(err)
+	}
+	writeresponse(resp)
+}
+
+// Upload with the resumable upload protocol, in chunks.  With a
+// non-zero maxduration, the upload is stopped after the first chunk
+// committed after maxduration.  If resume is set, it is the session url
+// of an earlier upload to continue, src is opened at the offset committed
+// by the server.  Continuecmd returns the command to continue an upload
+// that was stopped.
+func putresumable(path string, header http.Header, open source, maxduration time.Duration, resume string, continuecmd func(u *upload) string) {
+	var u *upload
+	var err error
+	if resume != "" {
+		u = &upload{url: resume}
+		err = u.query()
+	} else {
+		u, err = startupload(path, header)
+		if u != nil {
+			u.hash = newhasher()
+		}
+	}
+	if err != nil {
+		failerror(err)
+	}
+	src, err := open(u.offset)
+	if err != nil {
+		fail(err.Error())
+	}
+	var deadline time.Time
+	if maxduration > 0 {
+		deadline = time.Now().Add(maxduration)
+	}
+
+	buf := make([]byte, 0, chunksize)
+	for {
+		n, err := io.ReadFull(src, buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if u.hash != nil {
+				u.hash.Write(buf)
+			}
+			if err := u.writeretry(buf, true); err != nil {
+				failerror(err)
+			}
+			return
+		}
+		if err != nil {
+			u.cancel()
+			fail(err.Error() + ", upload cancelled")
+		}
+
+		start := u.offset
+		if err := u.writeretry(buf, false); err != nil {
+			fail(err.Error())
+		}
+		if u.hash != nil {
+			u.hash.Write(buf[:u.offset-start])
+		}
+		// Keep the data the server did not commit, for the next chunk.
+		buf = buf[:copy(buf, buf[u.offset-start:])]
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			checkpoint(continuecmd(u))
+		}
+	}
+}
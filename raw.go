@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Execute an arbitrary signed request, for reaching parts of the API
+// that have no command of their own.
+func raw(args []string) {
+	fs := flag.NewFlagSet("raw", flag.ExitOnError)
+	fs.Usage = usage
+	body := fs.Bool("body", false, "send stdin as request body")
+	var headers multiflag
+	fs.Var(&headers, "header", `add request header "name: value", can be repeated`)
+	include := fs.Bool("i", false, "print response status and headers to stderr")
+	args = parseflags(fs, args)
+	if len(args) != 2 {
+		usage()
+	}
+	method := strings.ToUpper(args[0])
+	path := makepath(args[1])
+
+	header := http.Header{}
+	for _, s := range headers {
+		t := strings.SplitN(s, ":", 2)
+		if len(t) != 2 || strings.TrimSpace(t[0]) == "" {
+			fail(fmt.Sprintf("bad header %q, must be name: value", s))
+		}
+		header.Add(strings.TrimSpace(t[0]), strings.TrimSpace(t[1]))
+	}
+	var r io.Reader
+	if *body {
+		r = os.Stdin
+	}
+
+	resp, err := request(method, path, header, r)
+	if err != nil {
+		fail(err.Error())
+	}
+	defer resp.Body.Close()
+	if *include {
+		fmt.Fprintln(os.Stderr, resp.Proto, resp.Status)
+		var keys []string
+		for k := range resp.Header {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range resp.Header[k] {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", k, v)
+			}
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+
+	ok := resp.StatusCode/100 == 2
+	out := os.Stdout
+	if !ok {
+		out = os.Stderr
+	}
+	_, err = io.Copy(out, resp.Body)
+	if !ok {
+		fail("status: " + resp.Status)
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Call fn for files, with concurrency calls at a time, as scheduled by
+// schedule.  Failures are printed.  With onerror "fail", no new calls are
+// started after a failure.  Returns the number of failed and skipped
+// files.
+func runall(files []syncfile, concurrency int, onerror string, fn func(f syncfile) error) (failed, skipped int) {
+	var mutex sync.Mutex
+	var stopped bool
+	schedule(files, concurrency, func(f syncfile) {
+		mutex.Lock()
+		if stopped {
+			skipped++
+			mutex.Unlock()
+			return
+		}
+		mutex.Unlock()
+
+		err := fn(f)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "error %s: %s\n", f.Name, err)
+			stopped = onerror == "fail"
+		}
+	})
+	return
+}
+
+// Exit with an error if files failed.
+func checkfailed(failed, skipped, total int) {
+	if skipped > 0 {
+		fail(fmt.Sprintf("stopped after %d failed files, %d files skipped", failed, skipped))
+	}
+	if failed > 0 {
+		fail(fmt.Sprintf("%d of %d files failed", failed, total))
+	}
+}
+
+// Upload the files in localdir to prefix, through filters.  With detect,
+// the content type of each file is detected.
+func putrecursive(localdir, prefix string, header http.Header, filters []filter, spec string, detect bool, concurrency int, onerror string) {
+	files, err := scanlocal(localdir)
+	if err != nil {
+		fail(err.Error())
+	}
+	failed, skipped := runall(files, concurrency, onerror, func(f syncfile) error {
+		p := prefix + f.Name
+		if err := putlocal(f.Path, p, header, filters, spec, detect); err != nil {
+			return err
+		}
+		fmt.Println(p)
+		return nil
+	})
+	checkfailed(failed, skipped, len(files))
+}
+
+// Upload local file lpath to path, through filters.  With detect, the
+// content type is detected.
+func putlocal(lpath, path string, header http.Header, filters []filter, spec string, detect bool) error {
+	lf, err := os.Open(lpath)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	h := http.Header{}
+	for k, v := range header {
+		h[k] = v
+	}
+	if detect {
+		t, err := filecontenttype(path, lf)
+		if err != nil {
+			return err
+		}
+		h.Set("Content-Type", t)
+	}
+	var src io.Reader = lf
+	if len(filters) > 0 {
+		if spec != "" {
+			h.Set(filtersheader, spec)
+		}
+		src, err = encodefilters(filters, lf, h)
+		if err != nil {
+			return err
+		}
+	} else {
+		gh, err := filehash(lf)
+		if err != nil {
+			return err
+		}
+		h.Set("x-goog-hash", gh.header())
+	}
+	resp, err := putobject(path, h, src)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Download the files under prefix in bucket to localdir, reversing
+// filters unless raw, and comparing hashes if verify.
+func getrecursive(bucket, prefix, localdir string, keys *keyopts, raw, verify bool, concurrency int, onerror string) {
+	var files []syncfile
+	err := listobjects(bucket, prefix, "", "", func(l []objectinfo, marker string) error {
+		for _, o := range l {
+			name := strings.TrimPrefix(o.Name, "/"+bucket+"/"+prefix)
+			// Skip "directory" placeholders and the marker of finalized backups.
+			if name == "" || strings.HasSuffix(name, "/") || name == donemarker {
+				continue
+			}
+			lpath, err := localpath(localdir, name)
+			if err != nil {
+				return err
+			}
+			files = append(files, syncfile{Name: name, Path: lpath, Size: o.Size, Op: "get", Generation: o.Generation})
+		}
+		return nil
+	})
+	if err != nil {
+		fail(fmt.Sprintf("listing /%s/%s: %s", bucket, prefix, err))
+	}
+	if raw {
+		keys = nil
+	}
+	failed, skipped := runall(files, concurrency, onerror, func(f syncfile) error {
+		p := "/" + bucket + "/" + prefix + f.Name
+		if _, err := getfile(p, f.Path, nil, keys, verify); err != nil {
+			return err
+		}
+		fmt.Println(f.Path)
+		return nil
+	})
+	checkfailed(failed, skipped, len(files))
+}
+
+// Local path for remote name under localdir.  Names that would end up
+// outside localdir are an error.
+func localpath(localdir, name string) (string, error) {
+	for _, s := range strings.Split(name, "/") {
+		if s == ".." {
+			return "", fmt.Errorf("name %q points outside of %s", name, localdir)
+		}
+	}
+	return filepath.Join(localdir, filepath.FromSlash(name)), nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+
+	"bitbucket.org/mjl/cloudstream/objects"
+)
+
+func rekey(args []string) {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	fs.Usage = usage
+	keys := keyflags(fs, "")
+	newkeys := keyflags(fs, "new-")
+	args = parseflags(fs, args)
+	if len(args) == 0 || !keys.enabled() || !newkeys.enabled() {
+		usage()
+	}
+	for _, p := range args {
+		if err := rekeyfile(makepath(p), keys, newkeys); err != nil {
+			fail(fmt.Sprintf("%s: %s", p, err))
+		}
+	}
+}
+
+// Re-wrap the data key of path under newkeys.  Only the metadata of
+// the object is replaced, the data is not transferred.
+func rekeyfile(path string, keys, newkeys *keyopts) error {
+	oh, err := head(path)
+	if err != nil {
+		return err
+	}
+	wrapped := oh.Get(encryptionheader)
+	if wrapped == "" {
+		return fmt.Errorf("not encrypted")
+	}
+	key, err := keys.datakey(wrapped)
+	if err != nil {
+		return err
+	}
+	nwrapped, err := newkeys.wrapdatakey(key)
+	if err != nil {
+		return err
+	}
+	return objectclient.Update(context.Background(), path, objects.ObjectUpdate{Set: http.Header{encryptionheader: {nwrapped}}})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Requests that fail with a network error, a server error or rate
+// limiting (429, or 503 "SlowDown" from S3) are tried again after a
+// delay, with exponential backoff: about 1s, 2s, 4s, up to 32s.  The
+// delay is randomized, so concurrent transfers do not retry in lockstep.
+// Requests with a streamed body cannot be sent again, uploads of streams
+// use resumable uploads for that, see upload.go.
+
+// Number of times a request is tried again, configurable with "retries".
+func retries() int {
+	if config.Retries < 0 {
+		return 5
+	}
+	return config.Retries
+}
+
+// Whether a request may succeed when tried again: after network errors,
+// server errors, and rate limiting.
+func retryable(err error) bool {
+	var he *httperror
+	if errors.As(err, &he) {
+		return he.Code >= 500 || he.Code == 429
+	}
+	return true
+}
+
+// Whether the response (or error) of a request is worth trying again.
+func transient(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500 || resp.StatusCode == 429
+}
+
+// Delay before try attempt+1, after a failed try with response resp, which
+// may be nil.  A Retry-After header in seconds is honored.
+func backoff(attempt int, resp *http.Response) time.Duration {
+	d := time.Second << uint(attempt)
+	if attempt > 5 {
+		d = 32 * time.Second
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	if resp != nil {
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(s)*time.Second > d {
+			d = time.Duration(s) * time.Second
+		}
+	}
+	return d
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+func rm(args []string) {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	fs.Usage = usage
+	force := fs.Bool("f", false, "ignore files that do not exist")
+	args = parseflags(fs, args)
+	if len(args) == 0 {
+		usage()
+	}
+	failed := 0
+	for _, arg := range args {
+		path := makepath(arg)
+		if err := deleteobject(path, nil); err != nil && !(*force && iserrorstatus(err, 404)) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// Delete object path.  Header may hold preconditions.
+func deleteobject(path string, header http.Header) error {
+	resp, err := request("DELETE", escapepath(path), header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 204 && resp.StatusCode != 200 {
+		return statuserror(resp)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Support for S3 and other S3-compatible servers, configured with
+// "endpoint".  Cloud storage accepts the x-amz- variants of most x-goog-
+// headers, other servers only know x-amz- headers.  S3 does not accept
+// uploads of unknown size, as with chunked transfer-encoding, so
+// streams are uploaded with a multipart upload instead: the data is read
+// in parts of partsize bytes, which are uploaded partconcurrency at a
+// time.
+
+// S3 requires parts of at least 5MB, except for the last.
+const minpartsize = 5 << 20
+
+// And an upload has at most 10000 parts, e.g. 160GB with the default part
+// size.
+const maxparts = 10000
+
+// Headers to send to an S3-compatible server for the x-goog- headers in h.
+// Only the precondition for a new object has an equivalent.  Of the
+// hashes, only the md5 can be checked, as Content-MD5.  A KMS key is an
+// AWS KMS key id.
+func s3requestheader(h http.Header) (http.Header, error) {
+	r := http.Header{}
+	for k, v := range h {
+		lk := strings.ToLower(k)
+		switch {
+		case lk == "x-goog-if-generation-match":
+			if len(v) != 1 || v[0] != "0" {
+				return nil, errors.New("generation preconditions need google cloud storage")
+			}
+			r.Set("If-None-Match", "*")
+		case lk == "x-goog-encryption-kms-key-name":
+			r.Set("x-amz-server-side-encryption", "aws:kms")
+			r["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = v
+		case lk == "x-goog-hash":
+			if gh := parsegooghash(http.Header{"X-Goog-Hash": v}); gh.md5 != "" {
+				r.Set("Content-MD5", gh.md5)
+			}
+		case strings.Contains(lk, "generation") && strings.HasPrefix(lk, "x-goog-"), lk == "x-goog-resumable":
+			return nil, fmt.Errorf("header %s needs google cloud storage", k)
+		case strings.HasPrefix(lk, "x-goog-"):
+			r[http.CanonicalHeaderKey("x-amz-"+lk[len("x-goog-"):])] = v
+		default:
+			r[k] = v
+		}
+	}
+	return r, nil
+}
+
+// Add x-goog- variants of the x-amz- headers of a response, for code
+// that looks for x-goog- headers, e.g. metadata for filters.
+func s3responseheader(h http.Header) {
+	for k, v := range h {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			gk := http.CanonicalHeaderKey("x-goog-" + lk[len("x-amz-"):])
+			if _, ok := h[gk]; !ok {
+				h[gk] = v
+			}
+		}
+	}
+}
+
+// Upload src to path.  Google Cloud Storage gets a single PUT request,
+// other servers a multipart upload.  The response has been checked for
+// success, the caller must close its body.
+func putobject(path string, header http.Header, src io.Reader) (*http.Response, error) {
+	if googlestorage() {
+		resp, err := request("PUT", escapepath(path), header, src)
+		if err == nil && resp.StatusCode != 200 {
+			err = statuserror(resp)
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+	return multipartput(path, header, src, multipartsize(), multipartconcurrency())
+}
+
+func multipartsize() int64 {
+	if config.PartSize == 0 {
+		return 16 << 20
+	}
+	return config.PartSize
+}
+
+func multipartconcurrency() int {
+	if config.PartConcurrency == 0 {
+		return 4
+	}
+	return config.PartConcurrency
+}
+
+type initiatemultipartresult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completepart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completemultipartupload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completepart `xml:"Part"`
+}
+
+// Upload src to path with a multipart upload.  Data smaller than a part
+// is uploaded with a single PUT request.  On failure, the upload is
+// aborted, so the parts do not linger.
+func multipartput(path string, header http.Header, src io.Reader, partsize int64, concurrency int) (*http.Response, error) {
+	first := make([]byte, partsize)
+	n, err := io.ReadFull(src, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		h := http.Header{}
+		for k, v := range header {
+			h[k] = v
+		}
+		h.Set("x-goog-hash", datahash(first[:n]).header())
+		resp, err := request("PUT", escapepath(path), h, bytes.NewReader(first[:n]))
+		if err == nil && resp.StatusCode != 200 {
+			err = statuserror(resp)
+			resp.Body.Close()
+		}
+		return resp, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	// A precondition applies to completing the upload.  The hashes of the
+	// whole object cannot be checked, those of the parts are.
+	initheader := http.Header{}
+	completeheader := http.Header{}
+	for k, v := range header {
+		if strings.EqualFold(k, "x-goog-if-generation-match") {
+			completeheader[k] = v
+		} else if !strings.EqualFold(k, "x-goog-hash") {
+			initheader[k] = v
+		}
+	}
+	resp, err := request("POST", escapepath(path)+"?uploads", initheader, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		return nil, statuserror(resp)
+	}
+	var init initiatemultipartresult
+	err = xml.NewDecoder(resp.Body).Decode(&init)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("parsing response to starting multipart upload: %s", err)
+	}
+	uploadpath := escapepath(path) + "?uploadId=" + url.QueryEscape(init.UploadID)
+
+	var mutex sync.Mutex
+	var completed []completepart
+	err = uploadparts(src, first, partsize, concurrency, func(number int, buf []byte) error {
+		// S3 would only reject the upload when completing it, after all data.
+		if number > maxparts {
+			return fmt.Errorf("more than %d parts of %s, set a larger part size", maxparts, formatsize(partsize))
+		}
+		etag, err := putpart(uploadpath, number, buf)
+		if err != nil {
+			return err
+		}
+		mutex.Lock()
+		completed = append(completed, completepart{number, etag})
+		mutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		abortmultipart(uploadpath)
+		return nil, err
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[i].PartNumber < completed[j].PartNumber
+	})
+	body, err := xml.Marshal(completemultipartupload{Parts: completed})
+	if err != nil {
+		return nil, err
+	}
+	resp, err = request("POST", uploadpath, completeheader, bytes.NewReader(body))
+	if err != nil {
+		abortmultipart(uploadpath)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result, err := io.ReadAll(resp.Body)
+	// Completing can fail after the 200 response has started, the error is
+	// in the body then.
+	if err == nil && resp.StatusCode == 200 && bytes.Contains(result, []byte("<Error>")) {
+		err = fmt.Errorf("completing multipart upload: %s", strings.TrimSpace(string(result)))
+	} else if err == nil && resp.StatusCode != 200 {
+		err = &httperror{Code: resp.StatusCode, Msg: fmt.Sprintf("completing multipart upload: status: %s: %s", resp.Status, strings.TrimSpace(string(result)))}
+	}
+	if err != nil {
+		abortmultipart(uploadpath)
+		return nil, err
+	}
+	// The caller gets the headers, the result describing the object is not
+	// of interest.
+	resp.Body = io.NopCloser(bytes.NewReader(nil))
+	return resp, nil
+}
+
+// Upload a part of a multipart upload, returning its etag.
+func putpart(uploadpath string, number int, buf []byte) (string, error) {
+	header := http.Header{"Content-MD5": {datahash(buf).md5}}
+	resp, err := request("PUT", fmt.Sprintf("%s&partNumber=%d", uploadpath, number), header, bytes.NewReader(buf))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", statuserror(resp)
+	}
+	io.Copy(io.Discard, resp.Body)
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", errors.New("no etag in response")
+	}
+	return etag, nil
+}
+
+func abortmultipart(uploadpath string) {
+	resp, err := request("DELETE", uploadpath, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Serve files from cloud storage over local http, with the credentials
+// of the configuration file.
+func serve(args []string) {
+	if len(args) == 0 {
+		usage()
+	}
+	mode, args := args[0], args[1:]
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = usage
+	listen := fs.String("listen", "localhost:8081", "address to listen on")
+	index := fs.String("index", "", "index document for directories, for www, default from the bucket website configuration or index.html")
+	notfound := fs.String("notfound", "", "page for missing files, for www, default from the bucket website configuration")
+	hostkey := fs.String("host-key", "", "file with the ssh private host key, for sftp")
+	var users multiflag
+	fs.Var(&users, "user", "user allowed to log in, as name=file, with file holding the authorized public keys, for sftp, can be repeated")
+	userdirs := fs.Bool("user-dirs", false, "give each user access to the directory with their name only, for sftp")
+	auth := fs.String("auth", "", "file with user:password lines, requiring http basic authentication, not for sftp")
+	args = parseflags(fs, args)
+	if len(args) != 1 {
+		usage()
+	}
+	prefix := makepath(args[0])
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var h http.Handler
+	switch mode {
+	case "media":
+		h = mediahandler(prefix)
+	case "www":
+		if *index == "" || *notfound == "" {
+			var wc websiteconfig
+			bucket, _ := splitpath(prefix)
+			if err := getbucketconfig(bucket, "websiteConfig", &wc); err != nil {
+				log.Printf("fetching website configuration: %s", err)
+			}
+			if *index == "" {
+				*index = wc.MainPageSuffix
+			}
+			if *notfound == "" {
+				*notfound = wc.NotFoundPage
+			}
+		}
+		if *index == "" {
+			*index = "index.html"
+		}
+		h = wwwhandler(prefix, *index, *notfound)
+	case "webdav":
+		h = davhandler(prefix)
+	case "sftp":
+		servesftp(prefix, *listen, *hostkey, users, *userdirs)
+		return
+	default:
+		usage()
+	}
+	if *auth != "" {
+		passwords, err := readpasswords(*auth)
+		if err != nil {
+			fail(err.Error())
+		}
+		h = basicauth(passwords, h)
+	}
+	log.Printf("serving %s on http://%s/", prefix, *listen)
+	fail(http.ListenAndServe(*listen, h).Error())
+}
+
+// Read passwords by user, from lines "user:password" in file p.  Empty
+// lines and lines starting with # are skipped.
+func readpasswords(p string) (map[string]string, error) {
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	passwords := map[string]string{}
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t := strings.SplitN(line, ":", 2)
+		if len(t) != 2 || t[0] == "" || t[1] == "" {
+			return nil, fmt.Errorf("%s:%d: bad line, must be user:password", p, i+1)
+		}
+		passwords[t[0]] = t[1]
+	}
+	if len(passwords) == 0 {
+		return nil, fmt.Errorf("%s: no users", p)
+	}
+	return passwords, nil
+}
+
+// Require http basic authentication with one of passwords before h.
+func basicauth(passwords map[string]string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		expected, known := passwords[user]
+		if !ok || !known || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cloudstream"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Request headers passed on to cloud storage, for ranged and
+// conditional requests.
+var proxyrequestheaders = []string{
+	"Range",
+	"If-Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+// Response headers passed back to the client.
+var proxyresponseheaders = []string{
+	"Accept-Ranges",
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"ETag",
+	"Last-Modified",
+}
+
+// Serve the objects under prefix, with the url path as name.  Ranged
+// requests are forwarded as such, so media players can seek, and
+// partial restores only fetch what they need.
+func mediahandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if name == "" || strings.HasSuffix(name, "/") || !proxyobject(w, r, prefix+name, 0) {
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// Bucket website configuration, for previewing a site.
+type websiteconfig struct {
+	XMLName        xml.Name `xml:"WebsiteConfiguration"`
+	MainPageSuffix string
+	NotFoundPage   string
+}
+
+// Serve the objects under prefix as a website, like cloud storage does
+// for buckets with a website configuration: index is served for
+// directories, and notfound, if set, for missing files.
+func wwwhandler(prefix, index, notfound string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if name == "" || strings.HasSuffix(name, "/") {
+			name += index
+		}
+		if proxyobject(w, r, prefix+name, 0) {
+			return
+		}
+		// Directories without trailing slash are redirected, for relative
+		// links in the index document.
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			if _, err := head(prefix + name + "/" + index); err == nil {
+				http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+				return
+			}
+		}
+		if notfound != "" {
+			// Without range and conditional headers, these are about the missing file.
+			nr := r.Clone(r.Context())
+			nr.Header = http.Header{}
+			if proxyobject(w, nr, prefix+notfound, http.StatusNotFound) {
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+}
+
+// Fetch object p with the ranged and conditional headers of r,
+// writing the response to w.  If status is non-zero, it replaces a
+// status 200.  Returns false, without writing a response, if the object
+// does not exist.
+func proxyobject(w http.ResponseWriter, r *http.Request, p string, status int) bool {
+	header := http.Header{}
+	for _, k := range proxyrequestheaders {
+		if v := r.Header.Values(k); len(v) > 0 {
+			header[k] = v
+		}
+	}
+	resp, err := request(r.Method, escapepath(p), header, nil)
+	if err != nil {
+		log.Printf("%s %s: %s", r.Method, p, err)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return true
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200, 206, 304, 412, 416:
+	case 404:
+		return false
+	default:
+		log.Printf("%s %s: %s", r.Method, p, statuserror(resp))
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return true
+	}
+	for _, k := range proxyresponseheaders {
+		if v := resp.Header.Values(k); len(v) > 0 {
+			w.Header()[k] = v
+		}
+	}
+	// Files uploaded without content-type get a generic one, try the extension.
+	if ct := resp.Header.Get("Content-Type"); ct == "" || ct == "application/octet-stream" {
+		if t := mime.TypeByExtension(path.Ext(p)); t != "" {
+			w.Header().Set("Content-Type", t)
+		}
+	}
+	if resp.StatusCode == 200 && status != 0 {
+		w.WriteHeader(status)
+	} else {
+		w.WriteHeader(resp.StatusCode)
+	}
+	if r.Method == "GET" {
+		io.Copy(w, resp.Body)
+	}
+	return true
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"bitbucket.org/mjl/cloudstream/objects"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP access to the files under a prefix, for backup appliances and
+// tools that only speak SFTP.  Users log in with a public key.  Files
+// are read with ranged requests, as stored, and uploads are streamed to
+// cloud storage, stored when the client closes the file.  Files can only
+// be written as a whole, not changed in place.
+
+// Serve prefix over SFTP on listen.  Users are "name=file", with file
+// holding the authorized public keys of the user, in OpenSSH format.
+// With userdirs, each user only has access to the directory with their
+// name under prefix.
+func servesftp(prefix, listen, hostkeyfile string, users []string, userdirs bool) {
+	if hostkeyfile == "" || len(users) == 0 {
+		fail("serve sftp needs -host-key and -user")
+	}
+	buf, err := os.ReadFile(hostkeyfile)
+	if err != nil {
+		fail(err.Error())
+	}
+	hostkey, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		fail(fmt.Sprintf("%s: %s", hostkeyfile, err))
+	}
+
+	// Authorized keys, and file systems, by user.
+	keys := map[string]map[string]bool{}
+	filesystems := map[string]*bucketfs{}
+	shared := &bucketfs{prefix: prefix}
+	for _, u := range users {
+		t := strings.SplitN(u, "=", 2)
+		if len(t) != 2 || t[0] == "" || strings.Contains(t[0], "/") {
+			fail(fmt.Sprintf("bad -user %q, must be name=file", u))
+		}
+		name, file := t[0], t[1]
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			fail(err.Error())
+		}
+		keys[name] = map[string]bool{}
+		for len(strings.TrimSpace(string(buf))) > 0 {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(buf)
+			if err != nil {
+				fail(fmt.Sprintf("%s: %s", file, err))
+			}
+			keys[name][string(key.Marshal())] = true
+			buf = rest
+		}
+		if userdirs {
+			filesystems[name] = &bucketfs{prefix: prefix + name + "/"}
+		} else {
+			filesystems[name] = shared
+		}
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if keys[conn.User()][string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostkey)
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		fail(err.Error())
+	}
+	log.Printf("serving %s on sftp://%s/", prefix, listen)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fail(err.Error())
+		}
+		go sftpconn(conn, config, filesystems)
+	}
+}
+
+func sftpconn(conn net.Conn, config *ssh.ServerConfig, filesystems map[string]*bucketfs) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Printf("sftp connection from %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	fs := sftpfs{filesystems[sconn.User()]}
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			log.Printf("sftp session for %s: %s", sconn.User(), err)
+			return
+		}
+		go func() {
+			for req := range requests {
+				// Payload is the length-prefixed subsystem name.
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}()
+		go func() {
+			defer ch.Close()
+			handlers := sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+			server := sftp.NewRequestServer(ch, handlers)
+			if err := server.Serve(); err != nil && err != io.EOF {
+				log.Printf("sftp session for %s: %s", sconn.User(), err)
+			}
+			server.Close()
+		}()
+	}
+}
+
+// SFTP handlers, implemented with a bucketfs.
+type sftpfs struct {
+	*bucketfs
+}
+
+func (fs sftpfs) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	fi, err := fs.stat(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.dir {
+		return nil, errors.New("is a directory")
+	}
+	return newobjectreader(fs.path(r.Filepath), fi.size, fi.etag), nil
+}
+
+func (fs sftpfs) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if r.Pflags().Append {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	p := fs.path(r.Filepath)
+	if p == fs.prefix {
+		return nil, os.ErrPermission
+	}
+	return &sftpwriter{w: newobjectwriter(p)}, nil
+}
+
+func (fs sftpfs) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		// Times and permissions are not stored, but clients setting them
+		// after an upload shouldn't fail.
+		return nil
+	case "Rename":
+		return fs.rename(r.Filepath, r.Target)
+	case "Rmdir":
+		return fs.rmdir(r.Filepath)
+	case "Mkdir":
+		return fs.mkdir(r.Filepath)
+	case "Remove":
+		return fs.remove(r.Filepath)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs sftpfs) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		l, err := fs.readdir(r.Filepath)
+		return sftplister(l), err
+	case "Stat":
+		fi, err := fs.stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return sftplister{fi}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type sftplister []os.FileInfo
+
+func (l sftplister) ListAt(fl []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(fl, l[offset:])
+	if offset+int64(n) == int64(len(l)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Data held for writes beyond the end of written data, at most.
+const sftpmaxpending = 16 * 1024 * 1024
+
+// Writer for an upload.  Clients can have multiple writes in flight,
+// which may come in out of order.  Writes after the data written so far
+// are held until the data before them is written.
+type sftpwriter struct {
+	w *objects.Writer
+
+	sync.Mutex
+	pending  map[int64][]byte
+	npending int64
+	err      error // Of the session, if it ended with the file open.
+}
+
+func (w *sftpwriter) WriteAt(buf []byte, offset int64) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if offset < w.w.Written() {
+		return 0, errors.New("files can only be written sequentially")
+	} else if offset > w.w.Written() {
+		if w.npending+int64(len(buf)) > sftpmaxpending {
+			return 0, errors.New("too much data written out of order")
+		}
+		if w.pending == nil {
+			w.pending = map[int64][]byte{}
+		}
+		w.pending[offset] = append([]byte(nil), buf...)
+		w.npending += int64(len(buf))
+		return len(buf), nil
+	}
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	for {
+		b, ok := w.pending[w.w.Written()]
+		if !ok {
+			break
+		}
+		delete(w.pending, w.w.Written())
+		w.npending -= int64(len(b))
+		if _, err := w.w.Write(b); err != nil {
+			return 0, err
+		}
+	}
+	return len(buf), nil
+}
+
+// Called before Close when the session ended with the file open.  The
+// upload is aborted instead of storing partial data.
+func (w *sftpwriter) TransferError(err error) {
+	w.Lock()
+	defer w.Unlock()
+	w.err = err
+}
+
+func (w *sftpwriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.err == nil && len(w.pending) > 0 {
+		w.err = errors.New("data missing before end of file")
+	}
+	if w.err != nil {
+		w.w.Abort(w.err)
+		return w.err
+	}
+	return w.w.Close()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Make HTTP authorization header for AWS-style authentication.
+func authorize(msg string) string {
+	h := hmac.New(sha1.New, []byte(config.Secret))
+	h.Write([]byte(msg))
+	sig := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	return fmt.Sprintf("AWS %s:%s", config.AccessKey, sig)
+}
+
+// Canonicalized extension headers, the x-goog- and x-amz- headers that
+// are part of the string to sign.  Names are lowercased, and sorted.
+// Values of a header, also of differently cased names, are joined with
+// a comma.  Whitespace around values is removed, and line breaks with
+// their surrounding whitespace in values are folded into a single space.
+func canonicalheaders(h http.Header) string {
+	// Go writes headers sorted by name, the values of differently cased
+	// names are joined in that order.
+	var names []string
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	values := map[string][]string{}
+	var keys []string
+	for _, name := range names {
+		k := strings.ToLower(name)
+		if !strings.HasPrefix(k, "x-goog-") && !strings.HasPrefix(k, "x-amz-") {
+			continue
+		}
+		if _, ok := values[k]; !ok {
+			keys = append(keys, k)
+			values[k] = nil
+		}
+		for _, v := range h[name] {
+			values[k] = append(values[k], foldvalue(v))
+		}
+	}
+	sort.Strings(keys)
+	s := ""
+	for _, k := range keys {
+		s += k + ":" + strings.Join(values[k], ",") + "\n"
+	}
+	return s
+}
+
+func foldvalue(v string) string {
+	lines := strings.Split(strings.Replace(v, "\r\n", "\n", -1), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSpace(l)
+	}
+	return strings.Join(lines, " ")
+}
+
+// Sub-resources, query parameters that are part of the signature.
+var subresources = map[string]bool{
+	"acl":              true,
+	"billing":          true,
+	"compose":          true,
+	"cors":             true,
+	"defaultObjectAcl": true,
+	"encryption":       true,
+	"generation":       true,
+	"lifecycle":        true,
+	"location":         true,
+	"logging":          true,
+	"partNumber":       true,
+	"storageClass":     true,
+	"tagging":          true,
+	"uploadId":         true,
+	"uploads":          true,
+	"versionId":        true,
+	"versioning":       true,
+	"versions":         true,
+	"websiteConfig":    true,
+}
+
+// Canonicalized resource of path for the string to sign: the path, and
+// the sub-resources of its query string, sorted by name, with their
+// values as sent.  Other query parameters, e.g. the prefix and marker of
+// a listing, are not part of it.
+func canonicalresource(path string) string {
+	i := strings.Index(path, "?")
+	if i < 0 {
+		return path
+	}
+	var params []string
+	for _, p := range strings.Split(path[i+1:], "&") {
+		name := p
+		if j := strings.Index(p, "="); j >= 0 {
+			name = p[:j]
+		}
+		if subresources[name] {
+			params = append(params, p)
+		}
+	}
+	path = path[:i]
+	if len(params) == 0 {
+		return path
+	}
+	sort.Slice(params, func(i, j int) bool {
+		return strings.SplitN(params[i], "=", 2)[0] < strings.SplitN(params[j], "=", 2)[0]
+	})
+	return path + "?" + strings.Join(params, "&")
+}
+
+// String to sign for a request with header, which must have the Date set.
+func stringtosign(method string, header http.Header, resource string) string {
+	msg := method + "\n"
+	msg += header.Get("Content-MD5") + "\n"
+	msg += header.Get("Content-Type") + "\n"
+	msg += header.Get("Date") + "\n"
+	msg += canonicalheaders(header)
+	msg += resource
+	return msg
+}
+
+// Sign request for path, setting the Date and Authorization headers, or
+// the headers of signature version 4 if configured.  With a service
+// account instead of an HMAC key, the request gets an access token.
+func sign(req *http.Request, path string) error {
+	if usebearer() {
+		tok, err := accesstoken()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+		return nil
+	}
+	if usev4() {
+		signv4(req, time.Now().Add(clockoffset))
+		return nil
+	}
+	req.Header.Set("Date", time.Now().Add(clockoffset).Format(time.RFC1123Z))
+	msg := stringtosign(req.Method, req.Header, canonicalresource(path))
+	req.Header.Set("Authorization", authorize(msg))
+	return nil
+}
+
+// Difference between the clock of cloud storage and the local clock,
+// added to the time in signatures.  Set when a request was rejected for
+// a skewed clock, and used for the rest of the run.
+var clockoffset time.Duration
+
+var clockchecked bool
+
+// Whether resp rejects a request because the time in its signature is too
+// far off.  If so, clockoffset is updated from the Date header of resp.
+// Otherwise, resp is left readable for the caller.
+func clockskewed(resp *http.Response) bool {
+	if resp.StatusCode != 403 {
+		return false
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, 4*1024))
+	resp.Body = readcloser{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+	if err != nil || !bytes.Contains(buf, []byte("RequestTimeTooSkewed")) {
+		return false
+	}
+	return setclockoffset(resp.Header)
+}
+
+// Set clockoffset from the Date header of a response, returning whether
+// it was parsed.
+func setclockoffset(h http.Header) bool {
+	t, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		return false
+	}
+	clockchecked = true
+	clockoffset = time.Until(t)
+	return true
+}
+
+// Compare the local clock against the server once per run, for requests
+// that cannot be retried after a clock skew error.
+func checkclock() {
+	if clockchecked {
+		return
+	}
+	clockchecked = true
+	resp, err := client.Head(endpoint() + "/")
+	if err != nil {
+		// The real request will fail too, with a better error.
+		return
+	}
+	resp.Body.Close()
+	// The Date header has second precision, keep the local clock for small
+	// differences.
+	if setclockoffset(resp.Header) && clockoffset > -time.Minute && clockoffset < time.Minute {
+		clockoffset = 0
+	}
+}
+
+type readcloser struct {
+	io.Reader
+	io.Closer
+}
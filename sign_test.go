@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// Names with special characters must be sent escaped, arrive at the
+// server as the original name, and be signed as the server sees them,
+// for both signature versions.
+func TestEscapeSign(t *testing.T) {
+	tests := []struct {
+		name    string
+		escaped string
+	}{
+		{"plain.txt", "/mybucket/plain.txt"},
+		{"dir/a b.txt", "/mybucket/dir/a%20b.txt"},
+		{"a+b", "/mybucket/a%2Bb"},
+		{"what?.txt", "/mybucket/what%3F.txt"},
+		{"a?compose", "/mybucket/a%3Fcompose"},
+		{"a#1&b=c%", "/mybucket/a%231%26b%3Dc%25"},
+		{"ünïcode/日本.txt", "/mybucket/%C3%BCn%C3%AFcode/%E6%97%A5%E6%9C%AC.txt"},
+	}
+	for _, test := range tests {
+		p := escapepath("/mybucket/" + test.name)
+		if p != test.escaped {
+			t.Errorf("%q: escapepath %q, expected %q", test.name, p, test.escaped)
+			continue
+		}
+
+		for _, query := range []string{"", "?compose"} {
+			req, err := http.NewRequest("PUT", "https://storage.googleapis.com"+p+query, nil)
+			if err != nil {
+				t.Fatalf("%q: new request: %s", test.name, err)
+			}
+			if s := req.URL.EscapedPath(); s != p {
+				t.Errorf("%q: url path sent as %q, expected %q", test.name, s, p)
+			}
+			if s, err := url.PathUnescape(req.URL.EscapedPath()); err != nil || s != "/mybucket/"+test.name {
+				t.Errorf("%q: server sees name %q (%v)", test.name, s, err)
+			}
+
+			// Version 2, the resource is the escaped path, with only real sub-resources.
+			if s := canonicalresource(p + query); s != p+query {
+				t.Errorf("%q%s: v2 resource %q, expected %q", test.name, query, s, p+query)
+			}
+
+			// Version 4, the canonical uri is the path as decoded by the server, escaped again.
+			if s := v4canonicaluri(req.URL.Path); s != p {
+				t.Errorf("%q: v4 canonical uri %q, expected %q", test.name, s, p)
+			}
+			expquery := ""
+			if query != "" {
+				expquery = "compose="
+			}
+			if s := v4canonicalquery(req.URL.RawQuery); s != expquery {
+				t.Errorf("%q%s: v4 canonical query %q, expected %q", test.name, query, s, expquery)
+			}
+		}
+	}
+}
+
+func TestCanonicalResource(t *testing.T) {
+	tests := []struct {
+		path, resource string
+	}{
+		{"/mybucket/a%3Fcompose", "/mybucket/a%3Fcompose"},
+		{"/mybucket/a%3Fcompose?compose", "/mybucket/a%3Fcompose?compose"},
+		{"/mybucket?prefix=a%20b&marker=x", "/mybucket"},
+		{"/mybucket/a%2Bb?uploadId=1&partNumber=2", "/mybucket/a%2Bb?partNumber=2&uploadId=1"},
+	}
+	for _, test := range tests {
+		if s := canonicalresource(test.path); s != test.resource {
+			t.Errorf("%q: resource %q, expected %q", test.path, s, test.resource)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Print how a request is signed, for investigating SignatureDoesNotMatch
+// errors.  Without -dry-run, the request is executed too: the error
+// response of cloud storage includes the string to sign it computed, to
+// compare against.
+func signcmd(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	fs.Usage = usage
+	dryrun := fs.Bool("dry-run", false, "only print the signature, do not execute the request")
+	args = parseflags(fs, args)
+	if len(args) < 2 {
+		usage()
+	}
+	method := strings.ToUpper(args[0])
+	path := makepath(args[1])
+	header := http.Header{}
+	for _, s := range args[2:] {
+		t := strings.SplitN(s, ":", 2)
+		if len(t) != 2 || strings.TrimSpace(t[0]) == "" {
+			fail(fmt.Sprintf("bad header %q, must be name: value", s))
+		}
+		header.Add(strings.TrimSpace(t[0]), strings.TrimSpace(t[1]))
+	}
+
+	req, err := http.NewRequest(method, requesturl(path), nil)
+	if err != nil {
+		fail(err.Error())
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if usebearer() {
+		fail("requests are authorized with an access token of the service account, not signed")
+	}
+	if usev4() {
+		canonical, msg := signv4(req, time.Now().Add(clockoffset))
+		fmt.Printf("canonical request (%q):\n", canonical)
+		for _, l := range strings.Split(canonical, "\n") {
+			fmt.Printf("\t%s\n", l)
+		}
+		fmt.Printf("string to sign (%q):\n", msg)
+		for _, l := range strings.Split(msg, "\n") {
+			fmt.Printf("\t%s\n", l)
+		}
+	} else {
+		if err := sign(req, path); err != nil {
+			fail(err.Error())
+		}
+		resource := canonicalresource(path)
+		msg := stringtosign(method, req.Header, resource)
+		fmt.Printf("canonical resource:\n\t%s\n", resource)
+		fmt.Printf("canonical headers:\n")
+		for _, l := range strings.Split(strings.TrimSuffix(canonicalheaders(req.Header), "\n"), "\n") {
+			if l != "" {
+				fmt.Printf("\t%s\n", l)
+			}
+		}
+		fmt.Printf("string to sign (%q):\n", msg)
+		for _, l := range strings.Split(msg, "\n") {
+			fmt.Printf("\t%s\n", l)
+		}
+	}
+	fmt.Printf("secret:\n\t<redacted, %d bytes>\n", len(config.Secret))
+	fmt.Printf("authorization:\n\t%s\n", req.Header.Get("Authorization"))
+	if *dryrun {
+		return
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fail(err.Error())
+	}
+	defer resp.Body.Close()
+	fmt.Printf("response:\n\t%s\n", resp.Status)
+	io.Copy(os.Stdout, io.LimitReader(resp.Body, 16*1024))
+}
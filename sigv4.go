@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, selected with "signature v4" in the
+// configuration file, and the default for other endpoints.  Cloud storage
+// accepts it with HMAC keys too, with region "auto".
+//
+// Request bodies are not hashed: uploads are streamed and their size is
+// not known beforehand, which rules out hashing them up front and also
+// STREAMING-AWS4-HMAC-SHA256-PAYLOAD, whose chunk signatures need the
+// decoded length of the data.  Bodies are sent as UNSIGNED-PAYLOAD
+// instead, TLS protects them in transit.
+
+const (
+	v4algorithm     = "AWS4-HMAC-SHA256"
+	v4unsigned      = "UNSIGNED-PAYLOAD"
+	v4emptypayload  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // sha256 of no data
+	v4amzdateformat = "20060102T150405Z"
+)
+
+// Region for signatures.  Without configured region, it is taken from
+// endpoints named like s3.<region>.<domain>, as used by AWS, Backblaze B2
+// and Wasabi, e.g. s3.us-west-004.backblazeb2.com.
+func region() string {
+	if config.Region != "" {
+		return config.Region
+	}
+	if googlestorage() {
+		return "auto"
+	}
+	host := endpoint()
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	t := strings.Split(host, ".")
+	if len(t) >= 4 && t[0] == "s3" {
+		return t[1]
+	}
+	return "us-east-1"
+}
+
+// Whether requests are signed with version 4.  Other servers than Google
+// Cloud Storage get version 4 by default, some, like AWS in newer regions
+// and Backblaze B2, do not accept version 2.
+func usev4() bool {
+	if config.Signature == "" {
+		return !googlestorage()
+	}
+	return config.Signature == "v4"
+}
+
+// Sign req with signature version 4 at time t, setting the x-amz-date,
+// x-amz-content-sha256 and Authorization headers.  The canonical request
+// and string to sign are returned, for the sign command.
+func signv4(req *http.Request, t time.Time) (canonical, msg string) {
+	t = t.UTC()
+	payload := v4emptypayload
+	if req.Body != nil && req.Body != http.NoBody {
+		payload = v4unsigned
+	}
+	req.Header.Set("x-amz-date", t.Format(v4amzdateformat))
+	req.Header.Set("x-amz-content-sha256", payload)
+
+	headers, signed := v4canonicalheaders(req)
+	canonical = strings.Join([]string{
+		req.Method,
+		v4canonicaluri(req.URL.Path),
+		v4canonicalquery(req.URL.RawQuery),
+		headers,
+		signed,
+		payload,
+	}, "\n")
+
+	scope := t.Format("20060102") + "/" + region() + "/s3/aws4_request"
+	h := sha256.Sum256([]byte(canonical))
+	msg = v4algorithm + "\n" + t.Format(v4amzdateformat) + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+	sig := hex.EncodeToString(hmacsha256(v4signingkey(t), msg))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", v4algorithm, config.AccessKey, scope, signed, sig))
+	return canonical, msg
+}
+
+func hmacsha256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// Key for signing on the day of t, derived from the secret.
+func v4signingkey(t time.Time) []byte {
+	k := hmacsha256([]byte("AWS4"+config.Secret), t.Format("20060102"))
+	k = hmacsha256(k, region())
+	k = hmacsha256(k, "s3")
+	return hmacsha256(k, "aws4_request")
+}
+
+// The (decoded) path, with everything but unreserved characters and
+// slashes percent-encoded, as the server does when verifying.
+func v4canonicaluri(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return escapepath(path)
+}
+
+// Query parameters sorted by name and value, with names and values
+// percent-encoded, including slashes.  Parameters without value, like
+// "versioning", get an empty value.
+func v4canonicalquery(rawquery string) string {
+	q, _ := url.ParseQuery(rawquery)
+	var l []string
+	for k, vs := range q {
+		for _, v := range vs {
+			l = append(l, v4escape(k)+"="+v4escape(v))
+		}
+	}
+	sort.Strings(l)
+	return strings.Join(l, "&")
+}
+
+func v4escape(s string) string {
+	return strings.Replace(escapepath(s), "/", "%2F", -1)
+}
+
+// Canonical headers and the list of signed headers.  The host, content
+// type and md5, and all x-amz- and x-goog- headers are signed.  Values
+// are trimmed, with runs of whitespace collapsed into a single space.
+func v4canonicalheaders(req *http.Request) (headers, signed string) {
+	// Values of differently cased names are joined in sorted order, as
+	// Go writes them.
+	var names []string
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := map[string][]string{"host": {req.URL.Host}}
+	for _, name := range names {
+		vs := req.Header[name]
+		k := strings.ToLower(name)
+		if k != "content-type" && k != "content-md5" && !strings.HasPrefix(k, "x-amz-") && !strings.HasPrefix(k, "x-goog-") {
+			continue
+		}
+		for _, v := range vs {
+			values[k] = append(values[k], strings.Join(strings.Fields(v), " "))
+		}
+	}
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		headers += k + ":" + strings.Join(values[k], ",") + "\n"
+	}
+	return headers, strings.Join(keys, ";")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func stat(args []string) {
+	fs := flag.NewFlagSet("stat", flag.ExitOnError)
+	fs.Usage = usage
+	args = parseflags(fs, args)
+	if len(args) == 0 {
+		usage()
+	}
+	for i, p := range args {
+		path := makepath(p)
+		h, err := head(path)
+		if iserrorstatus(err, 404) {
+			fail(fmt.Sprintf("%s: not found", path))
+		} else if err != nil {
+			fail(fmt.Sprintf("%s: %s", path, err))
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("name: %s\n", path)
+		fields := []struct{ name, header string }{
+			{"size", "Content-Length"},
+			{"etag", "ETag"},
+			{"content-type", "Content-Type"},
+			{"last-modified", "Last-Modified"},
+			{"custom-time", "x-goog-custom-time"},
+			{"generation", "x-goog-generation"},
+			{"storage-class", "x-goog-storage-class"},
+		}
+		for _, f := range fields {
+			if v := h.Get(f.header); v != "" {
+				fmt.Printf("%s: %s\n", f.name, v)
+			}
+		}
+		gh := parsegooghash(h)
+		if gh.crc32c != "" {
+			fmt.Printf("crc32c: %s\n", gh.crc32c)
+		}
+		if gh.md5 != "" {
+			fmt.Printf("md5: %s\n", gh.md5)
+		}
+		var meta []string
+		for k := range h {
+			if strings.HasPrefix(strings.ToLower(k), "x-goog-meta-") {
+				meta = append(meta, k)
+			}
+		}
+		sort.Strings(meta)
+		for _, k := range meta {
+			fmt.Printf("meta %s: %s\n", strings.ToLower(k[len("x-goog-meta-"):]), h.Get(k))
+		}
+	}
+}
@@ -0,0 +1,728 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File to sync, with the operation the sync needs for it.
+type syncfile struct {
+	Name       string // Relative to the synced directory, with slashes.
+	Path       string // Local path.
+	Size       int64
+	Modified   time.Time
+	Op         string // "put", "get", "delete-remote", "delete-local", or "conflict" to only report.
+	Check      bool   // Compare hashes first, equal files need no transfer.
+	Generation int64  // Of the remote file, 0 if absent.  For two-way, the transfer fails if it changed.
+}
+
+// Metadata header with the hex sha256 of the file contents, set by sync.
+const sha256header = "x-goog-meta-cloudstream-sha256"
+
+func syncdir(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	flags.Usage = usage
+	concurrency := flags.Int("concurrency", 4, "number of files to transfer at a time")
+	dryrun := flags.Bool("dry-run", false, "only print which files would be transferred")
+	compare := flags.String("compare", "size+mtime", "how to find changed files: size, size+mtime or checksum")
+	var cachefile string
+	if dir, err := os.UserCacheDir(); err == nil {
+		cachefile = filepath.Join(dir, "cloudstream", "digests.json")
+	}
+	flags.StringVar(&cachefile, "digest-cache", cachefile, "file with digests of local files, to skip hashing unmodified files, empty for none")
+	twoway := flags.Bool("two-way", false, "propagate changes in both directions, with the state of the previous run in -state")
+	statefile := flags.String("state", "", "file with the state after the previous sync, for two-way and retry-later")
+	winner := flags.String("winner", "", "for two-way, resolve files changed on both sides: local, remote or newer; default is to report them")
+	del := flags.Bool("delete", false, "remove remote files that are not present locally")
+	listcache := flags.String("list-cache", "", "file to keep the remote listing in, to skip listing in the next run")
+	listcachettl := flags.Duration("list-cache-ttl", time.Hour, "how long the -list-cache is used before listing again")
+	finalize := flags.Bool("finalize", false, "remove the done marker before changes, write it after all files were synced and verified")
+	backupdir := flags.String("backup-dir", "", "before overwriting or removing a remote file, copy it to a timestamped prefix under this path, e.g. /bucket/.trash/")
+	onerror := onerrorflag(flags)
+	args = parseflags(flags, args)
+	if len(args) != 2 || *concurrency < 1 {
+		usage()
+	}
+	switch *compare {
+	case "size", "size+mtime", "checksum":
+	default:
+		fail(fmt.Sprintf("unknown -compare %q, must be size, size+mtime or checksum", *compare))
+	}
+	switch *winner {
+	case "", "local", "remote", "newer":
+	default:
+		fail(fmt.Sprintf("unknown -winner %q, must be local, remote or newer", *winner))
+	}
+	if *twoway && *statefile == "" {
+		fail("-two-way needs a -state file")
+	}
+	if *twoway && *finalize {
+		fail("-finalize cannot be combined with -two-way")
+	}
+	checkonerror(*onerror, *statefile)
+	var trash string
+	if *backupdir != "" {
+		trash = strings.TrimSuffix(makepath(*backupdir), "/") + "/" + time.Now().UTC().Format("20060102T150405Z") + "/"
+	}
+	// Download when the remote path comes first, as URI.
+	download := isuri(args[0]) && !isuri(args[1])
+	localdir, remotepath := args[0], args[1]
+	if download {
+		localdir, remotepath = args[1], args[0]
+		if *twoway || *finalize {
+			fail("-two-way and -finalize cannot be used when downloading")
+		}
+	}
+	bucket, prefix := splitpath(makepath(remotepath))
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	// Backups under the prefix would be listed as remote files, and synced
+	// or removed by a next run.
+	if trash != "" && strings.HasPrefix(trash, "/"+bucket+"/"+prefix) {
+		fail("-backup-dir must not be under the synced prefix")
+	}
+
+	local, err := scanlocal(localdir)
+	if download && errors.Is(err, fs.ErrNotExist) {
+		local, err = nil, nil
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+	lc, err := readlistcache(*listcache, bucket, prefix, *listcachettl)
+	if err != nil {
+		fail(err.Error())
+	}
+	remote := lc.Files
+	if remote == nil {
+		remote = map[string]objectinfo{}
+		err = listobjects(bucket, prefix, "", "", func(l []objectinfo, marker string) error {
+			for _, o := range l {
+				if name := strings.TrimPrefix(o.Name, "/"+bucket+"/"+prefix); name != donemarker {
+					remote[name] = o
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			fail(fmt.Sprintf("listing /%s/%s: %s", bucket, prefix, err))
+		}
+		lc.Listed = time.Now()
+		lc.Files = remote
+	}
+
+	cache, err := opendigestcache(cachefile)
+	if err != nil {
+		fail(err.Error())
+	}
+
+	var state *syncstate
+	if *statefile != "" {
+		state, err = readsyncstate(*statefile)
+		if err != nil {
+			fail(err.Error())
+		}
+	}
+
+	var todo []syncfile
+	if *twoway {
+		todo = twowayops(localdir, local, remote, state, *winner)
+	} else {
+		// Files that failed in the previous run with retry-later are
+		// transferred again, even if they look unchanged.
+		retry := map[string]bool{}
+		if state != nil {
+			for _, name := range state.Retry {
+				retry[name] = true
+			}
+		}
+		if download {
+			todo = downloadops(localdir, local, remote, retry, *compare, *del)
+		} else {
+			todo = uploadops(local, remote, retry, *compare, *del)
+		}
+	}
+
+	if *finalize && len(todo) > 0 && !*dryrun {
+		if err := removedone(bucket, prefix); err != nil {
+			fail(fmt.Sprintf("removing done marker: %s", err))
+		}
+	}
+
+	if state != nil {
+		state.Retry = nil
+	}
+	var mutex sync.Mutex
+	var failed, conflicts, skipped int
+	var stopped bool
+	schedule(todo, *concurrency, func(f syncfile) {
+		mutex.Lock()
+		if stopped {
+			skipped++
+			mutex.Unlock()
+			return
+		}
+		mutex.Unlock()
+
+		p := "/" + bucket + "/" + prefix + f.Name
+		var sum string
+		var same bool
+		var generation int64
+		err := func() error {
+			var err error
+			if f.Check {
+				sum, same, err = unchanged(f, p, cache)
+			}
+			if err != nil || same || *dryrun {
+				return err
+			}
+			if trash != "" && f.Generation != 0 && (f.Op == "put" || f.Op == "delete-remote") {
+				// Copy the version that is replaced, not a newer one.
+				h := http.Header{"X-Goog-Copy-Source-If-Generation-Match": {fmt.Sprintf("%d", f.Generation)}}
+				if err := copyobject(p, trash+f.Name, h, true, false); err != nil {
+					return fmt.Errorf("copying to backup dir: %v", err)
+				}
+			}
+			generation, err = syncop(f, p, sum, *twoway)
+			return err
+		}()
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err == nil && !*dryrun && *twoway {
+			err = state.update(f, same, generation)
+		}
+		if err == nil && !*dryrun && !same {
+			lc.update(f, p, generation)
+		}
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(os.Stderr, "error %s %s: %s\n", f.Op, f.Name, err)
+			switch *onerror {
+			case "fail":
+				stopped = true
+			case "retry-later":
+				state.Retry = append(state.Retry, f.Name)
+			}
+		case same:
+		case f.Op == "conflict":
+			conflicts++
+			fmt.Printf("conflict %s\n", f.Name)
+		case *dryrun:
+			fmt.Printf("would %s %s\n", f.Op, f.Name)
+		default:
+			fmt.Printf("%s %s\n", f.Op, f.Name)
+		}
+	})
+	if err := cache.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "saving digest cache: %s\n", err)
+	}
+	if err := lc.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "saving list cache: %s\n", err)
+	}
+	if state != nil && !*dryrun {
+		if err := writefileatomic(*statefile, state); err != nil {
+			fail(fmt.Sprintf("writing state: %s", err))
+		}
+	}
+	if stopped {
+		fail(fmt.Sprintf("stopped after %d failed files, %d files skipped", failed, skipped))
+	}
+	if failed > 0 && *onerror == "retry-later" {
+		fmt.Fprintf(os.Stderr, "%d of %d files failed, queued for retry in the next run\n", failed, len(todo))
+		return
+	}
+	if failed > 0 {
+		fail(fmt.Sprintf("%d of %d files failed", failed, len(todo)))
+	}
+	if *finalize && !*dryrun {
+		done, err := finalized(bucket, prefix)
+		if err == nil && (!done || len(todo) > 0) {
+			err = writedone(bucket, prefix, local, cache)
+		}
+		if err != nil {
+			fail(fmt.Sprintf("finalizing: %s", err))
+		}
+		if err := cache.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "saving digest cache: %s\n", err)
+		}
+	}
+	if conflicts > 0 {
+		fail(fmt.Sprintf("%d conflicts, files changed on both sides, see -winner", conflicts))
+	}
+}
+
+// Operations for uploading.  Files are changed if their size differs.
+// Files modified after they were uploaded may just have a new mtime,
+// their hash is compared first.  With checksum, the hash of all files is
+// compared.  With del, remote files that are not present locally are
+// removed.
+func uploadops(local []syncfile, remote map[string]objectinfo, retry map[string]bool, compare string, del bool) []syncfile {
+	var ops []syncfile
+	present := map[string]bool{}
+	for _, f := range local {
+		present[f.Name] = true
+		f.Op = "put"
+		o, ok := remote[f.Name]
+		f.Generation = o.Generation
+		if !ok || o.Size != f.Size || retry[f.Name] {
+			ops = append(ops, f)
+		} else if compare == "checksum" || compare == "size+mtime" && f.Modified.After(o.Modified) {
+			f.Check = true
+			ops = append(ops, f)
+		}
+	}
+	if del {
+		for name, o := range remote {
+			if !present[name] {
+				ops = append(ops, syncfile{Name: name, Size: o.Size, Op: "delete-remote", Generation: o.Generation})
+			}
+		}
+	}
+	return ops
+}
+
+// Local path for remote file name under localdir, for downloading.
+// "Directory" placeholders and empty names are skipped, names pointing
+// outside localdir are skipped with a warning.
+func downloadpath(localdir, name string) (string, bool) {
+	if name == "" || strings.HasSuffix(name, "/") {
+		return "", false
+	}
+	lpath, err := localpath(localdir, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "skipping remote file: %s\n", err)
+		return "", false
+	}
+	return lpath, true
+}
+
+// Operations for downloading, like uploadops, the other way around.
+func downloadops(localdir string, local []syncfile, remote map[string]objectinfo, retry map[string]bool, compare string, del bool) []syncfile {
+	var ops []syncfile
+	localfiles := map[string]syncfile{}
+	for _, f := range local {
+		localfiles[f.Name] = f
+	}
+	for name, o := range remote {
+		lpath, ok := downloadpath(localdir, name)
+		if !ok {
+			continue
+		}
+		l, ok := localfiles[name]
+		f := syncfile{Name: name, Path: lpath, Size: o.Size, Modified: l.Modified, Op: "get", Generation: o.Generation}
+		if !ok || l.Size != o.Size || retry[name] {
+			ops = append(ops, f)
+		} else if compare == "checksum" || compare == "size+mtime" && o.Modified.Truncate(time.Second).After(l.Modified.Truncate(time.Second)) {
+			// Downloaded files get the mtime of Last-Modified, in seconds,
+			// listings have milliseconds.
+			f.Check = true
+			ops = append(ops, f)
+		}
+	}
+	if del {
+		for _, f := range local {
+			if _, ok := remote[f.Name]; !ok {
+				f.Op = "delete-local"
+				ops = append(ops, f)
+			}
+		}
+	}
+	return ops
+}
+
+// Execute the operation of f, for remote file p.  Sum is the sha256 of
+// the local file, if known.  With precondition, the operation fails if
+// the remote file changed since it was listed.  Returns the generation
+// of the file after a transfer.
+func syncop(f syncfile, p, sum string, precondition bool) (int64, error) {
+	header := http.Header{}
+	if precondition {
+		header.Set("x-goog-if-generation-match", fmt.Sprintf("%d", f.Generation))
+	}
+	switch f.Op {
+	case "put":
+		return putfile(p, f.Path, sum, header)
+	case "get":
+		return getfile(p, f.Path, header, nil, true)
+	case "delete-remote":
+		return 0, deleteobject(p, header)
+	case "delete-local":
+		return 0, os.Remove(f.Path)
+	}
+	return 0, nil
+}
+
+// Remote listing of a sync, kept for later runs, so frequent syncs of
+// prefixes with many files don't have to list them all each time.  The
+// changes made by sync itself are applied to it.
+type listcache struct {
+	path   string // Empty if the listing is not stored.
+	Bucket string
+	Prefix string
+	Listed time.Time
+	Files  map[string]objectinfo // By name relative to the prefix.
+}
+
+// Read the listing in p, if it is for bucket and prefix and not older
+// than ttl.  Otherwise the returned listing has no files.
+func readlistcache(p, bucket, prefix string, ttl time.Duration) (*listcache, error) {
+	lc := &listcache{path: p, Bucket: bucket, Prefix: prefix}
+	if p == "" {
+		return lc, nil
+	}
+	buf, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return lc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var c listcache
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, fmt.Errorf("parsing list cache %s: %v", p, err)
+	}
+	if c.Bucket == bucket && c.Prefix == prefix && time.Since(c.Listed) < ttl {
+		lc.Listed = c.Listed
+		lc.Files = c.Files
+	}
+	return lc, nil
+}
+
+// Apply the completed operation of f on remote file p.
+func (lc *listcache) update(f syncfile, p string, generation int64) {
+	switch f.Op {
+	case "put":
+		lc.Files[f.Name] = objectinfo{Name: p, Size: f.Size, Modified: time.Now(), Generation: generation}
+	case "delete-remote":
+		delete(lc.Files, f.Name)
+	}
+}
+
+func (lc *listcache) save() error {
+	if lc.path == "" {
+		return nil
+	}
+	return writefileatomic(lc.path, lc)
+}
+
+// Regular files under dir.
+func scanlocal(dir string) ([]syncfile, error) {
+	var l []syncfile
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || d.Name() == donemarker && filepath.Dir(p) == filepath.Clean(dir) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		l = append(l, syncfile{Name: filepath.ToSlash(rel), Path: p, Size: fi.Size(), Modified: fi.ModTime()})
+		return nil
+	})
+	return l, err
+}
+
+// Upload local file lpath to path, with the headers of header, returning
+// the generation of the new file.  The sha256 of its contents is stored
+// in the metadata, sum is the sha256 if already known.  The server checks
+// the crc32c and md5 of the data.
+func putfile(path, lpath, sum string, header http.Header) (int64, error) {
+	f, err := os.Open(lpath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sh := sha256.New()
+	gh := newhasher()
+	if _, err := io.Copy(io.MultiWriter(sh, gh), f); err != nil {
+		return 0, err
+	}
+	if sum == "" {
+		sum = hex.EncodeToString(sh.Sum(nil))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	h := http.Header{}
+	for k, v := range header {
+		h[k] = v
+	}
+	h.Set(sha256header, sum)
+	h.Set("x-goog-hash", gh.sum().header())
+	if h.Get("Content-Type") == "" {
+		t, err := filecontenttype(lpath, f)
+		if err != nil {
+			return 0, err
+		}
+		h.Set("Content-Type", t)
+	}
+	resp, err := putobject(path, h, f)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return generation(resp.Header)
+}
+
+// Download path to local file lpath, creating directories as needed,
+// returning the generation of the file.  The file gets the modification
+// time of the remote file.  The data is written to a
+// temporary file first, lpath is replaced only when complete.  With
+// non-nil keys, filters are reversed, otherwise the data is written as
+// stored, except for a gzip Content-Encoding.  With verify, the hashes of the data are compared with those of
+// the remote file.
+func getfile(path, lpath string, header http.Header, keys *keyopts, verify bool) (int64, error) {
+	h := http.Header{}
+	for k, v := range header {
+		h[k] = v
+	}
+	resp, err := request("GET", escapepath(path), acceptgzip(h), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, statuserror(resp)
+	}
+	if err := os.MkdirAll(filepath.Dir(lpath), 0777); err != nil {
+		return 0, err
+	}
+	tmp := lpath + ".cloudstream-tmp"
+	var src io.Reader = resp.Body
+	var vr *verifyreader
+	if verify {
+		vr = newverifyreader(resp.Body, expectedhash(resp.Header))
+		src = vr
+	}
+	src, err = contentdecode(src, resp.Header)
+	if err != nil {
+		return 0, err
+	}
+	if spec := resp.Header.Get(filtersheader); spec != "" && keys != nil {
+		filters, err := parsefilters(spec, keys)
+		if err != nil {
+			return 0, err
+		}
+		src, err = decodefilters(filters, src, resp.Header)
+		if err != nil {
+			return 0, err
+		}
+	}
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(f, src)
+	if err == nil && vr != nil {
+		if err = vr.verify(); err != nil {
+			err = fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			os.Chtimes(tmp, t, t)
+		}
+		err = os.Rename(tmp, lpath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return generation(resp.Header)
+}
+
+// Generation of a file from a response, 0 for servers other than Google
+// Cloud Storage, which do not have generations.
+func generation(h http.Header) (int64, error) {
+	if !googlestorage() {
+		return 0, nil
+	}
+	return strconv.ParseInt(h.Get("x-goog-generation"), 10, 64)
+}
+
+// Whether local file f has the same contents as remote file path, by the
+// sha256 stored by sync, or else the md5 of cloud storage, or for files
+// without md5, like composite files, the crc32c.  The sha256 of f is
+// returned for uploading.
+func unchanged(f syncfile, path string, cache *digestcache) (string, bool, error) {
+	rh, err := head(path)
+	if err != nil {
+		return "", false, err
+	}
+	d, err := cache.digest(f)
+	if err != nil {
+		return "", false, err
+	}
+	if stored := rh.Get(sha256header); stored != "" {
+		return d.SHA256, stored == d.SHA256, nil
+	}
+	stored := expectedhash(rh)
+	if stored.md5 != "" {
+		return d.SHA256, stored.md5 == d.MD5, nil
+	}
+	return d.SHA256, stored.crc32c != "" && stored.crc32c == d.CRC32C, nil
+}
+
+// Digests of local files, kept between runs so unmodified files are not
+// hashed again.  Entries are valid while size and mtime of the file are
+// unchanged.
+type digestcache struct {
+	path    string // Empty if the cache is not stored.
+	mutex   sync.Mutex
+	files   map[string]digest // By absolute path.
+	changed bool
+}
+
+type digest struct {
+	Size     int64
+	Modified time.Time
+	SHA256   string // Hex.
+	MD5      string // Base64, as in x-goog-hash.
+	CRC32C   string // Base64, as in x-goog-hash.
+}
+
+func opendigestcache(p string) (*digestcache, error) {
+	c := &digestcache{path: p, files: map[string]digest{}}
+	if p == "" {
+		return c, nil
+	}
+	buf, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &c.files); err != nil {
+		return nil, fmt.Errorf("parsing digest cache %s: %v", p, err)
+	}
+	return c, nil
+}
+
+// Digest of f, from the cache, or by hashing the file.
+func (c *digestcache) digest(f syncfile) (digest, error) {
+	abs, err := filepath.Abs(f.Path)
+	if err != nil {
+		return digest{}, err
+	}
+	c.mutex.Lock()
+	d, ok := c.files[abs]
+	c.mutex.Unlock()
+	// Entries from before the crc32c was kept are computed again.
+	if ok && d.Size == f.Size && d.Modified.Equal(f.Modified) && d.CRC32C != "" {
+		return d, nil
+	}
+
+	lf, err := os.Open(f.Path)
+	if err != nil {
+		return digest{}, err
+	}
+	defer lf.Close()
+	h := sha256.New()
+	gh := newhasher()
+	if _, err := io.Copy(io.MultiWriter(h, gh), lf); err != nil {
+		return digest{}, err
+	}
+	sum := gh.sum()
+	d = digest{f.Size, f.Modified, hex.EncodeToString(h.Sum(nil)), sum.md5, sum.crc32c}
+	c.mutex.Lock()
+	c.files[abs] = d
+	c.changed = true
+	c.mutex.Unlock()
+	return d, nil
+}
+
+func (c *digestcache) save() error {
+	if c.path == "" || !c.changed {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	return writefileatomic(c.path, c.files)
+}
+
+// Files of at least this size are large for scheduling.
+const largefile = 64 << 20
+
+// Call fn for each file, with concurrency calls at a time.  Large files
+// start first, largest first, on workers of their own.  The other
+// workers go through the small files.  A large file found at the end
+// would otherwise take long on its own, and many small files would not
+// use much bandwidth while they hold up large files.  Workers that ran
+// out of work take from the other queue.
+func schedule(files []syncfile, concurrency int, fn func(f syncfile)) {
+	files = append([]syncfile{}, files...)
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Size > files[j].Size
+	})
+	n := sort.Search(len(files), func(i int) bool { return files[i].Size < largefile })
+	large, small := files[:n], files[n:]
+
+	nlarge := concurrency / 2
+	if len(small) == 0 {
+		nlarge = concurrency
+	} else if len(large) == 0 {
+		nlarge = 0
+	} else if nlarge == 0 {
+		nlarge = 1
+	}
+
+	var mutex sync.Mutex
+	next := func(preferlarge bool) (syncfile, bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		q := &small
+		if preferlarge && len(large) > 0 || len(small) == 0 {
+			q = &large
+		}
+		if len(*q) == 0 {
+			return syncfile{}, false
+		}
+		f := (*q)[0]
+		*q = (*q)[1:]
+		return f, true
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(preferlarge bool) {
+			defer wg.Done()
+			for {
+				f, ok := next(preferlarge)
+				if !ok {
+					return
+				}
+				fn(f)
+			}
+		}(i < nlarge)
+	}
+	wg.Wait()
+}
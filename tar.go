@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Directory trees as a single tar file, instead of a file per local
+// file.  Many small files are slow to upload and list, and cost a
+// request each.  The tar stream is made while uploading, and extracted
+// while downloading, no local copy of the archive is needed.
+
+func puttar(args []string) {
+	fs := flag.NewFlagSet("put-tar", flag.ExitOnError)
+	fs.Usage = usage
+	keys := keyflags(fs, "")
+	fs.Var(&keys.recipients, "encrypt-to", "encrypt with age to recipient, an age1... public key or file with keys, can be repeated")
+	ciphername := fs.String("cipher", "aes-256-gcm", "cipher for encryption, aes-256-gcm or xchacha20-poly1305")
+	filterspec := fs.String("filters", config.Filters, "filter pipeline, e.g. gzip,encrypt")
+	compress := fs.String("compress", "", "compress with gzip[:level] or zstd[:level], before the other filters")
+	args = parseflags(fs, args)
+	if len(args) != 2 {
+		usage()
+	}
+	localdir, path := args[0], makepath(args[1])
+	if fi, err := os.Stat(localdir); err != nil {
+		fail(err.Error())
+	} else if !fi.IsDir() {
+		fail(localdir + ": not a directory")
+	}
+	spec, filters := putfilters(*filterspec, *compress, *ciphername, keys)
+
+	header := http.Header{}
+	if spec != "" {
+		header.Set(filtersheader, spec)
+	} else {
+		header.Set("Content-Type", "application/x-tar")
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writetar(pw, localdir))
+	}()
+	src, err := encodefilters(filters, pr, header)
+	if err != nil {
+		fail(err.Error())
+	}
+	putstream(path, header, src)
+}
+
+// Write a tar stream of the files in dir to w.  Directories, regular
+// files and symlinks are stored, with their permissions and mtimes.
+// Other files, like sockets, are skipped with a warning.
+func writetar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		} else if !fi.Mode().IsRegular() && !fi.IsDir() {
+			fmt.Fprintf(os.Stderr, "%s: skipping, not a regular file, directory or symlink\n", p)
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// Only the size in the header can be written, a file that grows is
+		// stored up to its size when walked.
+		if _, err := io.CopyN(tw, f, hdr.Size); err == io.EOF {
+			return fmt.Errorf("%s: file shrunk while reading", p)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func gettar(args []string) {
+	fs := flag.NewFlagSet("get-tar", flag.ExitOnError)
+	fs.Usage = usage
+	keys := keyflags(fs, "")
+	fs.StringVar(&keys.identityfile, "identity", "", "file with age identities, for decrypting files encrypted with -encrypt-to")
+	args = parseflags(fs, args)
+	if len(args) != 2 {
+		usage()
+	}
+	path, localdir := makepath(args[0]), args[1]
+
+	resp, err := request("GET", escapepath(path), acceptgzip(nil), nil)
+	if err != nil {
+		fail(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		failerror(statuserror(resp))
+	}
+	vr := newverifyreader(resp.Body, expectedhash(resp.Header))
+	src, err := contentdecode(vr, resp.Header)
+	if err != nil {
+		fail(err.Error())
+	}
+	if spec := resp.Header.Get(filtersheader); spec != "" {
+		filters, err := parsefilters(spec, keys)
+		if err != nil {
+			fail(err.Error())
+		}
+		src, err = decodefilters(filters, src, resp.Header)
+		if err != nil {
+			fail(err.Error())
+		}
+	}
+	if err := os.MkdirAll(localdir, 0777); err != nil {
+		fail(err.Error())
+	}
+	if err := extracttar(src, localdir); err != nil {
+		fail(err.Error())
+	}
+	// Reads the padding after the end of the archive too.
+	if err := vr.verify(); err != nil {
+		fail(err.Error())
+	}
+}
+
+// Extract the tar stream r into dir, restoring permissions and mtimes,
+// and owners when running as root.  Names pointing outside dir, also
+// through symlinks extracted earlier, are an error.
+func extracttar(r io.Reader, dir string) error {
+	type dirattr struct {
+		path string
+		mode os.FileMode
+		t    time.Time
+	}
+	// Directories get their permissions and mtime after their files are
+	// written, they may not be writable.
+	var dirs []dirattr
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		p, err := localpath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if err := checkparents(dir, p); err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirattr{p, mode, hdr.ModTime})
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+				return err
+			}
+			// A symlink in its place is replaced, not followed.
+			if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				if err := os.Remove(p); err != nil {
+					return err
+				}
+			}
+			f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if err == nil {
+				err = f.Close()
+			} else {
+				f.Close()
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", p, err)
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+				return err
+			}
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeSymlink {
+				err = os.Symlink(hdr.Linkname, p)
+			} else {
+				var target string
+				if target, err = localpath(dir, hdr.Linkname); err == nil {
+					err = os.Link(target, p)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "%s: skipping, not a regular file, directory or link\n", hdr.Name)
+			continue
+		}
+		if os.Geteuid() == 0 {
+			if err := os.Lchown(p, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := os.Chmod(p, mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(p, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if err := os.Chmod(d.path, d.mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(d.path, d.t, d.t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check that the directories between dir and p are not symlinks, which
+// could point outside dir.
+func checkparents(dir, p string) error {
+	rel, err := filepath.Rel(dir, filepath.Dir(p))
+	if err != nil || rel == "." {
+		return err
+	}
+	d := dir
+	for _, s := range strings.Split(rel, string(filepath.Separator)) {
+		d = filepath.Join(d, s)
+		fi, err := os.Lstat(d)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s: path goes through symlink %s", p, d)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// State after a sync.  For two-way sync, the baseline for finding
+// changes on either side in the next run.
+type syncstate struct {
+	Files map[string]syncbase // By name relative to the synced directory.
+	Retry []string            // Names of files that failed, with -on-error retry-later.
+}
+
+type syncbase struct {
+	Size       int64
+	Modified   time.Time // Of the local file.
+	Generation int64     // Of the remote file.
+}
+
+func readsyncstate(p string) (*syncstate, error) {
+	state := &syncstate{Files: map[string]syncbase{}}
+	buf, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, state); err != nil {
+		return nil, fmt.Errorf("parsing state %s: %v", p, err)
+	}
+	if state.Files == nil {
+		state.Files = map[string]syncbase{}
+	}
+	return state, nil
+}
+
+// Update the state after the operation of f completed.  Same is set if
+// the files turned out to be equal, generation is that of a transferred
+// file.
+func (s *syncstate) update(f syncfile, same bool, generation int64) error {
+	if same {
+		s.Files[f.Name] = syncbase{f.Size, f.Modified, f.Generation}
+		return nil
+	}
+	switch f.Op {
+	case "put":
+		s.Files[f.Name] = syncbase{f.Size, f.Modified, generation}
+	case "get":
+		fi, err := os.Stat(f.Path)
+		if err != nil {
+			return err
+		}
+		s.Files[f.Name] = syncbase{fi.Size(), fi.ModTime(), generation}
+	case "delete-remote", "delete-local":
+		delete(s.Files, f.Name)
+	}
+	// Conflicts keep their old state, so they are found again.
+	return nil
+}
+
+// Operations for a two-way sync.  Files changed on one side since the
+// previous sync, by size and mtime locally, and by generation remotely,
+// are copied to the other side, and files removed on one side are
+// removed on the other.  Files changed on both sides are conflicts,
+// resolved by winner: "local", "remote", "newer" or "" to report them.
+func twowayops(localdir string, local []syncfile, remote map[string]objectinfo, state *syncstate, winner string) []syncfile {
+	localfiles := map[string]syncfile{}
+	names := map[string]struct{}{}
+	for _, f := range local {
+		localfiles[f.Name] = f
+		names[f.Name] = struct{}{}
+	}
+	for name := range remote {
+		names[name] = struct{}{}
+	}
+	for name := range state.Files {
+		names[name] = struct{}{}
+	}
+
+	var ops []syncfile
+	for name := range names {
+		// Remote names could point outside localdir, for get and delete-local.
+		lpath, ok := downloadpath(localdir, name)
+		if !ok {
+			continue
+		}
+		l, lok := localfiles[name]
+		r, rok := remote[name]
+		b, bok := state.Files[name]
+		lchanged := lok != bok || lok && (l.Size != b.Size || !l.Modified.Equal(b.Modified))
+		rchanged := rok != bok || rok && r.Generation != b.Generation
+		if !lchanged && !rchanged {
+			continue
+		}
+		if !lok && !rok {
+			delete(state.Files, name)
+			continue
+		}
+
+		f := syncfile{Name: name, Path: lpath, Generation: r.Generation}
+		if lok {
+			f.Size, f.Modified = l.Size, l.Modified
+		} else {
+			f.Size = r.Size
+		}
+		putop := "put"
+		if !lok {
+			putop = "delete-remote"
+		}
+		getop := "get"
+		if !rok {
+			getop = "delete-local"
+		}
+		switch {
+		case lchanged && !rchanged:
+			f.Op = putop
+		case !lchanged && rchanged:
+			f.Op = getop
+		case winner == "local":
+			f.Op = putop
+		case winner == "remote":
+			f.Op = getop
+		case winner == "newer":
+			// A changed file wins over a removed one.
+			if !rok || lok && l.Modified.After(r.Modified) {
+				f.Op = putop
+			} else {
+				f.Op = getop
+			}
+		default:
+			f.Op = "conflict"
+		}
+		if f.Op == "get" {
+			f.Size = r.Size
+		}
+		// Files changed on both sides may have become equal.
+		f.Check = lok && rok && l.Size == r.Size && lchanged && rchanged
+		ops = append(ops, f)
+	}
+	return ops
+}
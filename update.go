@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"bitbucket.org/mjl/cloudstream/objects"
+)
+
+// Flag that can be specified multiple times.
+type multiflag []string
+
+func (m *multiflag) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *multiflag) Set(v string) error {
+	*m = append(*m, v)
+	return nil
+}
+
+// Parse "key=value" into an x-goog-meta- header.
+func metaheader(h http.Header, kv string) error {
+	t := strings.SplitN(kv, "=", 2)
+	if len(t) != 2 || t[0] == "" {
+		return fmt.Errorf("bad metadata %q, must be key=value", kv)
+	}
+	h.Set("x-goog-meta-"+t[0], t[1])
+	return nil
+}
+
+// Set the x-goog-custom-time header, for lifecycle rules.  The time must
+// be in RFC3339 format.
+func customtimeheader(h http.Header, s string) error {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return fmt.Errorf("bad custom time %q, must be RFC3339, e.g. 2014-06-01T00:00:00Z", s)
+	}
+	h.Set("x-goog-custom-time", t.UTC().Format(time.RFC3339))
+	return nil
+}
+
+func setmeta(args []string) {
+	fs := flag.NewFlagSet("setmeta", flag.ExitOnError)
+	fs.Usage = usage
+	contenttype := fs.String("content-type", "", "set content-type")
+	cachecontrol := fs.String("cache-control", "", "set cache-control")
+	customtime := fs.String("custom-time", "", "set custom time, in RFC3339 format")
+	var meta, removemeta multiflag
+	fs.Var(&meta, "meta", "set custom metadata key=value, can be repeated")
+	fs.Var(&removemeta, "remove-meta", "remove custom metadata key, can be repeated")
+	args = parseflags(fs, args)
+	if len(args) == 0 {
+		usage()
+	}
+
+	u := objects.ObjectUpdate{Set: http.Header{}}
+	if *contenttype != "" {
+		u.Set.Set("Content-Type", *contenttype)
+	}
+	if *cachecontrol != "" {
+		u.Set.Set("Cache-Control", *cachecontrol)
+	}
+	if *customtime != "" {
+		if err := customtimeheader(u.Set, *customtime); err != nil {
+			fail(err.Error())
+		}
+	}
+	for _, kv := range meta {
+		if err := metaheader(u.Set, kv); err != nil {
+			fail(err.Error())
+		}
+	}
+	for _, k := range removemeta {
+		u.Remove = append(u.Remove, "x-goog-meta-"+k)
+	}
+	if len(u.Set) == 0 && len(u.Remove) == 0 {
+		fail("nothing to change")
+	}
+	for _, p := range args {
+		if err := objectclient.Update(context.Background(), makepath(p), u); err != nil {
+			fail(fmt.Sprintf("%s: %s", p, err))
+		}
+	}
+}
+
+func rewrite(args []string) {
+	fs := flag.NewFlagSet("rewrite", flag.ExitOnError)
+	fs.Usage = usage
+	class := fs.String("storage-class", "", "new storage class, e.g. NEARLINE, COLDLINE or ARCHIVE")
+	args = parseflags(fs, args)
+	if len(args) == 0 || *class == "" {
+		usage()
+	}
+	u := objects.ObjectUpdate{StorageClass: strings.ToUpper(*class)}
+	for _, p := range args {
+		if err := objectclient.Update(context.Background(), makepath(p), u); err != nil {
+			fail(fmt.Sprintf("%s: %s", p, err))
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chunk size for resumable uploads.  Must be a multiple of 256KB.
+const chunksize = 8 << 20
+
+// Resumable upload session, see
+// https://cloud.google.com/storage/docs/resumable-uploads.  The session
+// url, returned when starting the upload, identifies and authorizes the
+// upload.  Requests to it are not signed.
+type upload struct {
+	url    string
+	offset int64 // Number of bytes committed by the server.
+
+	// Hashes of the data up to offset, and of the final chunk once it is
+	// written, for the server to check the complete object.  Nil for a
+	// session continued from an earlier run.
+	hash *hasher
+}
+
+// Start a resumable upload for path.  Header holds the headers for the
+// object, e.g. preconditions.
+func startupload(path string, header http.Header) (*upload, error) {
+	h := http.Header{}
+	for k, v := range header {
+		h[k] = v
+	}
+	h.Set("x-goog-resumable", "start")
+	resp, err := request("POST", escapepath(path), h, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return nil, statuserror(resp)
+	}
+	u := &upload{url: resp.Header.Get("Location")}
+	if u.url == "" {
+		return nil, fmt.Errorf("missing upload session url in response")
+	}
+	return u, nil
+}
+
+var errcompleted = errors.New("upload already completed")
+
+// Fetch the number of bytes committed by the server, for continuing an
+// upload session.
+func (u *upload) query() error {
+	req, err := http.NewRequest("PUT", u.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Range", "bytes */*")
+	if csekkey != nil {
+		csekheader(req.Header, "x-goog-", csekkey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 308:
+		return u.committed(resp)
+	case 200, 201:
+		return errcompleted
+	}
+	return statuserror(resp)
+}
+
+// Parse the Range header of a "308 Resume Incomplete" response, e.g.
+// "bytes=0-1048575".  No header means nothing has been committed yet.
+func (u *upload) committed(resp *http.Response) error {
+	r := resp.Header.Get("Range")
+	if r == "" {
+		u.offset = 0
+		return nil
+	}
+	t := strings.SplitN(strings.TrimPrefix(r, "bytes="), "-", 2)
+	if len(t) != 2 || t[0] != "0" {
+		return fmt.Errorf("bad range %q in response", r)
+	}
+	end, err := strconv.ParseInt(t[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad range %q in response", r)
+	}
+	u.offset = end + 1
+	return nil
+}
+
+// Send buf, the data starting at u.offset.  The server may commit less
+// than all of buf, u.offset is updated to what it committed.  If final
+// is set, buf is the remainder of the data and the upload is finished.
+func (u *upload) write(buf []byte, final bool) error {
+	req, err := http.NewRequest("PUT", u.url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	end := u.offset + int64(len(buf))
+	switch {
+	case final && len(buf) == 0:
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", end))
+	case final:
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", u.offset, end-1, end))
+	default:
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", u.offset, end-1))
+	}
+	if final && u.hash != nil {
+		req.Header.Set("x-goog-hash", u.hash.sum().header())
+	}
+	if csekkey != nil {
+		csekheader(req.Header, "x-goog-", csekkey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == 308 && !final:
+		return u.committed(resp)
+	case (resp.StatusCode == 200 || resp.StatusCode == 201) && final:
+		u.offset = end
+		return nil
+	}
+	return statuserror(resp)
+}
+
+// Send buf like write, but after a network or server error, query the
+// offset committed by the server and send the remainder again.
+func (u *upload) writeretry(buf []byte, final bool) error {
+	start := u.offset
+	var err error
+	for attempt := 0; attempt <= retries(); attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff(attempt-1, nil))
+			qerr := u.query()
+			if qerr == errcompleted && final {
+				// The final chunk arrived, the response did not.
+				u.offset = start + int64(len(buf))
+				return nil
+			} else if qerr != nil {
+				if !retryable(qerr) {
+					return qerr
+				}
+				err = qerr
+				continue
+			}
+			if u.offset < start || u.offset > start+int64(len(buf)) {
+				return fmt.Errorf("server committed offset %d, outside of chunk at offset %d", u.offset, start)
+			}
+		}
+		err = u.write(buf[u.offset-start:], final)
+		if err == nil || !retryable(err) {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "upload interrupted at offset %d: %s, continuing\n", u.offset, err)
+	}
+	return err
+}
+
+// Cancel the upload session.  The object is not created.
+func (u *upload) cancel() error {
+	req, err := http.NewRequest("DELETE", u.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 499 && resp.StatusCode != 204 {
+		return statuserror(resp)
+	}
+	return nil
+}
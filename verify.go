@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Outcome of verifying an object.
+type verifyresult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // "ok", "mismatch", "nohash", "missing" or "error".
+	Detail string `json:"detail,omitempty"`
+}
+
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = usage
+	remoteonly := fs.Bool("remote-only", false, "download the files and check them against the stored hashes")
+	concurrency := fs.Int("concurrency", 4, "number of files to verify at a time")
+	jsonlines := fs.Bool("json-lines", false, "print each result as json object on a line")
+	checkpoint := fs.String("checkpoint", "", "keep progress in file, and continue from it after an interruption")
+	args = parseflags(fs, args)
+	if (*remoteonly && len(args) != 1) || (!*remoteonly && len(args) != 2) || *concurrency < 1 {
+		usage()
+	}
+	bucket, prefix := splitpath(makepath(args[0]))
+	var localdir string
+	if !*remoteonly {
+		localdir = args[1]
+	}
+
+	check := func(o objectinfo) verifyresult {
+		if *remoteonly {
+			return verifyremote(o.Name)
+		}
+		rel := strings.TrimPrefix(o.Name, "/"+bucket+"/"+prefix)
+		return verifylocal(o.Name, filepath.Join(localdir, filepath.FromSlash(rel)))
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
+	counts := map[string]int{}
+	err := listcheckpointed(*checkpoint, bucket, prefix, "", &counts, func(l []objectinfo) error {
+		results := make([]verifyresult, len(l))
+		var wg sync.WaitGroup
+		work := make(chan int)
+		for i := 0; i < *concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range work {
+					results[i] = check(l[i])
+				}
+			}()
+		}
+		for i := range l {
+			work <- i
+		}
+		close(work)
+		wg.Wait()
+
+		for _, r := range results {
+			counts[r.Status]++
+			if *jsonlines {
+				if err := enc.Encode(r); err != nil {
+					return err
+				}
+			} else if r.Detail != "" {
+				fmt.Fprintf(out, "%s %s: %s\n", r.Status, r.Name, r.Detail)
+			} else {
+				fmt.Fprintf(out, "%s %s\n", r.Status, r.Name)
+			}
+		}
+		return out.Flush()
+	})
+	if err != nil {
+		fail(err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "verified: %d ok, %d mismatch, %d missing, %d without hash, %d errors\n", counts["ok"], counts["mismatch"], counts["missing"], counts["nohash"], counts["error"])
+	if counts["mismatch"] > 0 || counts["missing"] > 0 || counts["error"] > 0 {
+		os.Exit(1)
+	}
+}
+
+// Download the object and compare its data against its stored hashes.
+func verifyremote(path string) verifyresult {
+	r := verifyresult{Name: path}
+	resp, err := request("GET", escapepath(path), nil, nil)
+	if err != nil {
+		r.Status, r.Detail = "error", err.Error()
+		return r
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		r.Status, r.Detail = "error", statuserror(resp).Error()
+		return r
+	}
+	expected := parsegooghash(resp.Header)
+	if expected == (googhash{}) {
+		r.Status = "nohash"
+		return r
+	}
+	h := newhasher()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		r.Status, r.Detail = "error", err.Error()
+		return r
+	}
+	return hashresult(r, expected, h.sum())
+}
+
+// Compare the hashes of local file p against the stored hashes of the object.
+func verifylocal(path, p string) verifyresult {
+	r := verifyresult{Name: path}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		r.Status, r.Detail = "missing", p
+		return r
+	} else if err != nil {
+		r.Status, r.Detail = "error", err.Error()
+		return r
+	}
+	defer f.Close()
+
+	resp, err := request("HEAD", escapepath(path), nil, nil)
+	if err != nil {
+		r.Status, r.Detail = "error", err.Error()
+		return r
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		r.Status, r.Detail = "error", "status: "+resp.Status
+		return r
+	}
+	expected := parsegooghash(resp.Header)
+	if expected == (googhash{}) {
+		r.Status = "nohash"
+		return r
+	}
+	h := newhasher()
+	if _, err := io.Copy(h, f); err != nil {
+		r.Status, r.Detail = "error", err.Error()
+		return r
+	}
+	return hashresult(r, expected, h.sum())
+}
+
+func hashresult(r verifyresult, expected, got googhash) verifyresult {
+	if msg := expected.mismatch(got); msg != "" {
+		r.Status, r.Detail = "mismatch", msg
+	} else {
+		r.Status = "ok"
+	}
+	return r
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"bitbucket.org/mjl/cloudstream/objects"
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV access to the files under a prefix, for file managers and
+// tools that can't use cloud storage.  Slashes in names separate
+// directories, see bucketfs.  Files are read with ranged requests, as
+// stored, and written by streaming the request body to an upload.
+
+// Serve prefix over WebDAV.  Uploads are only stored when the request
+// body was read completely.
+func davhandler(prefix string) http.Handler {
+	dh := &webdav.Handler{
+		FileSystem: davfs{&bucketfs{prefix: prefix}},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			b := &davbody{r: r.Body}
+			r.Body = b
+			r = r.WithContext(context.WithValue(r.Context(), davbodykey{}, b))
+		}
+		dh.ServeHTTP(w, r)
+	})
+}
+
+// Body of a PUT request.  The webdav handler closes the file after
+// copying the body, also when reading it failed.  The file checks the
+// error of the body to abort the upload instead.
+type davbody struct {
+	r   io.ReadCloser
+	err error
+}
+
+type davbodykey struct{}
+
+func (b *davbody) Read(buf []byte) (int, error) {
+	n, err := b.r.Read(buf)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *davbody) Close() error {
+	return b.r.Close()
+}
+
+// WebDAV file system, implemented with a bucketfs.
+type davfs struct {
+	*bucketfs
+}
+
+func (d davfs) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := d.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (d davfs) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	p := d.path(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		// Files can only be written as a whole.
+		if p == d.prefix || flag&os.O_TRUNC == 0 {
+			return nil, os.ErrPermission
+		}
+		body, _ := ctx.Value(davbodykey{}).(*davbody)
+		return &davfile{fs: d.bucketfs, name: name, info: bucketinfo{name: path.Base(p)}, w: newobjectwriter(p), body: body}, nil
+	}
+	info, err := d.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	f := &davfile{fs: d.bucketfs, name: name, info: info}
+	if !info.dir {
+		f.r = newobjectreader(p, info.size, info.etag)
+	}
+	return f, nil
+}
+
+func (d davfs) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return d.mkdir(name)
+}
+
+func (d davfs) RemoveAll(ctx context.Context, name string) error {
+	return d.removeall(name)
+}
+
+func (d davfs) Rename(ctx context.Context, oldname, newname string) error {
+	return d.rename(oldname, newname)
+}
+
+// File or directory opened for a request.  Exactly one of r and w is set
+// for files, neither for directories.
+type davfile struct {
+	fs   *bucketfs
+	name string
+	info bucketinfo
+	r    *objects.Reader
+	w    *objects.Writer
+	body *davbody // Of a PUT request, for w.
+
+	entries []os.FileInfo // For Readdir, nil until listed.
+}
+
+func (f *davfile) Close() error {
+	if f.w == nil {
+		return nil
+	}
+	if f.body != nil && f.body.err != nil {
+		f.w.Abort(f.body.err)
+		return f.body.err
+	}
+	return f.w.Close()
+}
+
+func (f *davfile) Read(buf []byte) (int, error) {
+	if f.r == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.r.Read(buf)
+}
+
+func (f *davfile) Seek(offset int64, whence int) (int64, error) {
+	if f.r == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.r.Seek(offset, whence)
+}
+
+func (f *davfile) Write(buf []byte) (int, error) {
+	if f.w == nil {
+		return 0, os.ErrPermission
+	}
+	return f.w.Write(buf)
+}
+
+func (f *davfile) Stat() (os.FileInfo, error) {
+	if f.w != nil {
+		return bucketinfo{name: f.info.name, size: f.w.Written(), modified: time.Now()}, nil
+	}
+	return f.info, nil
+}
+
+func (f *davfile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.info.dir {
+		return nil, os.ErrInvalid
+	}
+	if f.entries == nil {
+		l, err := f.fs.readdir(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.entries = l
+	}
+	if count <= 0 {
+		l := f.entries
+		f.entries = f.entries[len(f.entries):]
+		return l, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	l := f.entries[:count]
+	f.entries = f.entries[count:]
+	return l, nil
+}
+
+// The etag and content-type are provided for the webdav handler, so it
+// doesn't have to compute them from the data.
+
+func (fi bucketinfo) ETag(ctx context.Context) (string, error) {
+	if fi.etag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.etag, nil
+}
+
+func (fi bucketinfo) ContentType(ctx context.Context) (string, error) {
+	if fi.contenttype != "" {
+		return fi.contenttype, nil
+	}
+	if t := extensiontype(fi.name); t != "" {
+		return t, nil
+	}
+	return "", webdav.ErrNotImplemented
+}